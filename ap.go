@@ -1,53 +1,141 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"github.com/fiatjaf/litepub"
 	strip "github.com/grokify/html-strip-tags-go"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip10"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slices"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ActivityPubProvider interface {
-	NoteToEvent(note *litepub.Note) (*nostr.Event, error)
-	ActorToEvent(actor *litepub.Actor) (*nostr.Event, error)
-	ActorFollowsToEvent(actor *litepub.Actor) (*nostr.Event, error)
+	NoteToEvent(ctx context.Context, note *Note) (*nostr.Event, error)
+	ArticleToEvent(ctx context.Context, article *Note) (*nostr.Event, error)
+	ActorToEvent(ctx context.Context, actor *Actor) (*nostr.Event, error)
+	ActorFollowsToEvent(ctx context.Context, actor *Actor) (*nostr.Event, error)
+	ActorPinsToEvent(ctx context.Context, actor *Actor) (*nostr.Event, error)
+	DeletionEvent(ctx context.Context, actorUrl string, eventIDs ...string) (*nostr.Event, error)
+	ReactionEvent(ctx context.Context, react *EmojiReact) (*nostr.Event, error)
+	AcceptFollow(ctx context.Context, follow litepub.Follow) error
+	RejectFollow(ctx context.Context, follow litepub.Follow) error
+	FollowRemote(ctx context.Context, nostrPubkey string, targetActorUrl string) error
+	UnfollowRemote(ctx context.Context, nostrPubkey string, targetActorUrl string) error
+	SyncFollows(ctx context.Context, contactList nostr.Event) error
 }
 
 type ActivityPub struct {
 	db       StorageProvider
 	nostr    NostrProvider
+	fetcher  FetchProvider
 	settings Settings
 }
 
-func NewActivityPub(db StorageProvider, nostr NostrProvider, settings Settings) ActivityPubProvider {
+func NewActivityPub(db StorageProvider, nostr NostrProvider, fetcher FetchProvider, settings Settings) ActivityPubProvider {
 	return &ActivityPub{
 		db,
 		nostr,
+		fetcher,
 		settings,
 	}
 }
 
-func (ap *ActivityPub) NoteToEvent(note *litepub.Note) (*nostr.Event, error) {
-	privkey, pubkey, err := ap.nostr.GetNostrKeysByActor(note.AttributedTo)
+func (ap *ActivityPub) NoteToEvent(ctx context.Context, note *Note) (*nostr.Event, error) {
+	ctx, span := tracer.Start(ctx, "ActivityPub.NoteToEvent", trace.WithAttributes(attribute.String("note", note.Id)))
+	defer span.End()
+
+	privkey, pubkey, err := ap.nostr.GetNostrKeysByActor(ctx, note.AttributedTo)
 	if err != nil {
 		return nil, err
 	}
 
 	tags := make(nostr.Tags, 0, 2)
-	// "e" tags
+	// "e" tags (NIP-10 marked)
+	var replyID, rootID string
 	if note.InReplyTo != "" {
-		if eventID, err := ap.db.GetNoteURLByEventID(note.InReplyTo); err == nil {
-			if eventID != "" {
-				tags = append(tags, nostr.Tag{"e", eventID, ap.settings.RelayURL})
-			} else {
-				if replyNote, err := litepub.FetchNote(note.InReplyTo); err == nil {
-					event, _ := ap.NoteToEvent(replyNote) // @warn will recurse until the start of the thread
-					tags = append(tags, nostr.Tag{"e", event.ID, ap.settings.RelayURL})
+		if eventID, err := ap.db.GetEventIDByNoteURL(ctx, note.InReplyTo); err == nil && eventID != "" {
+			replyID = eventID
+			rootID, _ = ap.db.GetThreadRootID(ctx, eventID)
+		} else if replyNote, err := ap.fetcher.FetchNote(note.InReplyTo); err == nil {
+			if parent, err := ap.NoteToEvent(ctx, replyNote); err == nil { // @warn will recurse until the start of the thread
+				replyID = parent.ID
+				if root := nip10.GetThreadRoot(parent.Tags); root != nil {
+					rootID = root.Value()
 				}
 			}
 		}
+
+		if replyID != "" {
+			if rootID == "" {
+				rootID = replyID
+			}
+
+			if rootID != replyID {
+				tags = append(tags, nostr.Tag{"e", rootID, ap.settings.RelayURL, "root"})
+			}
+			tags = append(tags, nostr.Tag{"e", replyID, ap.settings.RelayURL, "reply"})
+		}
+	}
+
+	// content warnings go in a NIP-36 tag, plain subjects in a "subject" one
+	lang, content := ap.noteLanguage(note)
+	content = htmlToText(content, ap.settings.HTMLPolicy) + pollOptions(note)
+	if lang != "" {
+		// NIP-32 language label
+		tags = append(tags, nostr.Tag{"L", "ISO-639-1"}, nostr.Tag{"l", lang, "ISO-639-1"})
+	}
+
+	// attachments go at the end as links, which is what clients display, described by NIP-92 "imeta" tags
+	for _, attachment := range note.Attachment {
+		link := string(attachment.URL)
+		if link == "" {
+			continue
+		}
+		if !strings.Contains(content, link) {
+			content += "\n" + link
+		}
+
+		imeta := nostr.Tag{"imeta", "url " + link}
+		if attachment.MediaType != "" {
+			imeta = append(imeta, "m "+attachment.MediaType)
+		}
+		if attachment.Name != "" {
+			imeta = append(imeta, "alt "+attachment.Name)
+		}
+		tags = append(tags, imeta)
+	}
+
+	if note.Sensitive {
+		if note.Summary == "" {
+			tags = append(tags, nostr.Tag{"content-warning"})
+		} else {
+			tags = append(tags, nostr.Tag{"content-warning", note.Summary})
+			// clients that don't understand the tag should still show the warning before anything else
+			content = contentWarningPrefix(note.Summary) + content
+		}
+	} else if note.Summary != "" {
+		tags = append(tags, nostr.Tag{"subject", note.Summary})
+	}
+
+	// NIP-30 custom emoji, only those actually used as the content is all clients will look at
+	for _, tag := range note.Tag {
+		shortcode := strings.Trim(tag.Name, ":")
+		if tag.Type != "Emoji" || tag.Icon == nil || tag.Icon.URL == "" || !isShortcode(shortcode) {
+			continue
+		}
+		if strings.Contains(content, ":"+shortcode+":") {
+			tags = append(tags, nostr.Tag{"emoji", shortcode, tag.Icon.URL})
+		}
 	}
 
 	// "p" tags
@@ -56,7 +144,7 @@ func (ap *ActivityPub) NoteToEvent(note *litepub.Note) (*nostr.Event, error) {
 			continue
 		}
 
-		_, pk, _ := ap.nostr.GetNostrKeysByActor(a)
+		_, pk, _ := ap.nostr.GetNostrKeysByActor(ctx, a)
 		tags = append(tags, nostr.Tag{"p", pk, ap.settings.RelayURL})
 	}
 
@@ -65,25 +153,33 @@ func (ap *ActivityPub) NoteToEvent(note *litepub.Note) (*nostr.Event, error) {
 		PubKey:    pubkey,
 		Tags:      tags,
 		Kind:      1,
-		Content:   strip.StripTags(note.Content),
+		Content:   content,
 	}
 
 	if err := event.Sign(privkey); err != nil {
 		log.Warn().Err(err).Interface("evt", event).Msg("fail to sign an event")
 	}
+	conversions.Inc("note_to_event")
 
-	go func() {
-		err := ap.db.SaveNote(event.ID, note.Id)
+	tasks.Go(func() {
+		err := ap.db.SaveNote(context.Background(), event.ID, event.PubKey, note.Id)
 		if err != nil {
 			log.Warn().Err(err).Msg("fail to save note")
 		}
-	}()
+
+		if err := ap.db.SaveNoteThread(context.Background(), event, replyID, rootID); err != nil {
+			log.Warn().Err(err).Msg("fail to save note thread")
+		}
+	})
 
 	return &event, nil
 }
 
-func (ap *ActivityPub) ActorToEvent(actor *litepub.Actor) (*nostr.Event, error) {
-	privkey, pubkey, err := ap.nostr.GetNostrKeysByActor(actor.Id)
+func (ap *ActivityPub) ActorToEvent(ctx context.Context, actor *Actor) (*nostr.Event, error) {
+	ctx, span := tracer.Start(ctx, "ActivityPub.ActorToEvent", trace.WithAttributes(attribute.String("actor", actor.Id)))
+	defer span.End()
+
+	privkey, pubkey, err := ap.nostr.GetNostrKeysByActor(ctx, actor.Id)
 	if err != nil {
 		return nil, err
 	}
@@ -117,20 +213,24 @@ func (ap *ActivityPub) ActorToEvent(actor *litepub.Actor) (*nostr.Event, error)
 	if err := event.Sign(privkey); err != nil {
 		log.Warn().Err(err).Interface("evt", event).Msg("fail to sign an event")
 	}
+	conversions.Inc("actor_to_event")
 
 	return &event, nil
 }
 
-func (ap *ActivityPub) ActorFollowsToEvent(actor *litepub.Actor) (*nostr.Event, error) {
-	privkey, pubkey, err := ap.nostr.GetNostrKeysByActor(actor.Id)
+func (ap *ActivityPub) ActorFollowsToEvent(ctx context.Context, actor *Actor) (*nostr.Event, error) {
+	ctx, span := tracer.Start(ctx, "ActivityPub.ActorFollowsToEvent", trace.WithAttributes(attribute.String("actor", actor.Id)))
+	defer span.End()
+
+	privkey, pubkey, err := ap.nostr.GetNostrKeysByActor(ctx, actor.Id)
 	if err != nil {
 		return nil, err
 	}
 
-	follows, _ := litepub.FetchFollowing(actor.Following)
+	follows, _ := ap.fetcher.FetchFollowing(actor.Following)
 	tags := make(nostr.Tags, len(follows))
 	for i, followedUrl := range follows {
-		_, followedPubKey, err := ap.nostr.GetNostrKeysByActor(followedUrl)
+		_, followedPubKey, err := ap.nostr.GetNostrKeysByActor(ctx, followedUrl)
 		if err != nil {
 			log.Warn().Err(err).Msg("fail to get nostr keys for followed actor")
 			continue
@@ -149,6 +249,421 @@ func (ap *ActivityPub) ActorFollowsToEvent(actor *litepub.Actor) (*nostr.Event,
 	if err := event.Sign(privkey); err != nil {
 		log.Warn().Err(err).Interface("evt", event).Msg("fail to sign an event")
 	}
+	conversions.Inc("follows_to_event")
+
+	return &event, nil
+}
+
+// ActorPinsToEvent bridges the notes in the actor's featured collection and builds the NIP-51 pinned notes list
+// pointing at them. Actors without a featured collection get an empty list.
+func (ap *ActivityPub) ActorPinsToEvent(ctx context.Context, actor *Actor) (*nostr.Event, error) {
+	ctx, span := tracer.Start(ctx, "ActivityPub.ActorPinsToEvent", trace.WithAttributes(attribute.String("actor", actor.Id)))
+	defer span.End()
+
+	privkey, pubkey, err := ap.nostr.GetNostrKeysByActor(ctx, actor.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var eventIDs []string
+	if notes, err := ap.fetchPins(actor); err == nil {
+		for i := range notes {
+			event, err := ap.NoteToEvent(ctx, &notes[i])
+			if err != nil {
+				log.Warn().Err(err).Str("note", notes[i].Id).Msg("fail to bridge pinned note")
+				continue
+			}
+			eventIDs = append(eventIDs, event.ID)
+		}
+
+		if err := ap.db.SavePins(ctx, pubkey, eventIDs); err != nil {
+			log.Warn().Err(err).Msg("fail to save pins")
+		}
+	} else if eventIDs, err = ap.db.GetPins(ctx, pubkey); err != nil {
+		// the pins we saw last time are still better than nothing
+		return nil, err
+	}
+
+	tags := make(nostr.Tags, len(eventIDs))
+	for i, id := range eventIDs {
+		tags[i] = nostr.Tag{"e", id, ap.settings.RelayURL}
+	}
+
+	event := nostr.Event{
+		CreatedAt: time.Now(),
+		PubKey:    pubkey,
+		Tags:      tags,
+		Kind:      10001,
+	}
+
+	if err := event.Sign(privkey); err != nil {
+		log.Warn().Err(err).Interface("evt", event).Msg("fail to sign an event")
+	}
+	conversions.Inc("pins_to_event")
+
+	return &event, nil
+}
+
+func (ap *ActivityPub) fetchPins(actor *Actor) ([]Note, error) {
+	if actor.Featured == "" {
+		return nil, nil
+	}
+
+	return ap.fetcher.FetchFeatured(actor.Featured)
+}
+
+// DeletionEvent builds a NIP-09 deletion event for notes bridged from the given actor.
+func (ap *ActivityPub) DeletionEvent(ctx context.Context, actorUrl string, eventIDs ...string) (*nostr.Event, error) {
+	privkey, pubkey, err := ap.nostr.GetNostrKeysByActor(ctx, actorUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(nostr.Tags, len(eventIDs))
+	for i, id := range eventIDs {
+		tags[i] = nostr.Tag{"e", id}
+	}
+
+	event := nostr.Event{
+		CreatedAt: time.Now(),
+		PubKey:    pubkey,
+		Tags:      tags,
+		Kind:      5,
+		Content:   "deleted on the fediverse",
+	}
+
+	if err := event.Sign(privkey); err != nil {
+		log.Warn().Err(err).Interface("evt", event).Msg("fail to sign an event")
+	}
+	conversions.Inc("deletion_event")
+
+	return &event, nil
+}
+
+// ReactionEvent turns an emoji reaction into a NIP-25 reaction to the event the reacted note is, or became
+// once bridged, with a NIP-30 emoji tag when the emoji is a custom one.
+func (ap *ActivityPub) ReactionEvent(ctx context.Context, react *EmojiReact) (*nostr.Event, error) {
+	ctx, span := tracer.Start(ctx, "ActivityPub.ReactionEvent", trace.WithAttributes(attribute.String("reaction", react.Id)))
+	defer span.End()
+
+	privkey, pubkey, err := ap.nostr.GetNostrKeysByActor(ctx, react.Actor)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := ap.reactedEvent(ctx, objectID(react.Object))
+	if err != nil {
+		return nil, err
+	}
+
+	content := react.Content
+	if content == "" {
+		content = "+"
+	}
+
+	tags := nostr.Tags{{"e", target.ID, ap.settings.RelayURL}, {"p", target.PubKey, ap.settings.RelayURL}}
+	for _, tag := range react.Tag {
+		shortcode := strings.Trim(tag.Name, ":")
+		if tag.Type == "Emoji" && tag.Icon != nil && tag.Icon.URL != "" && isShortcode(shortcode) && content == ":"+shortcode+":" {
+			tags = append(tags, nostr.Tag{"emoji", shortcode, tag.Icon.URL})
+		}
+	}
+
+	event := nostr.Event{
+		CreatedAt: time.Now(),
+		PubKey:    pubkey,
+		Tags:      tags,
+		Kind:      7,
+		Content:   content,
+	}
+
+	if err := event.Sign(privkey); err != nil {
+		log.Warn().Err(err).Interface("evt", event).Msg("fail to sign an event")
+	}
+	conversions.Inc("reaction_event")
+
+	return &event, nil
+}
+
+// reactedEvent finds the event a reaction is about, be it one of ours or a fediverse note, which gets bridged
+// if it wasn't already.
+func (ap *ActivityPub) reactedEvent(ctx context.Context, noteUrl string) (*nostr.Event, error) {
+	eventID := ""
+	if strings.HasPrefix(noteUrl, ap.settings.ServiceURL+"/pub/note/") {
+		eventID = strings.TrimPrefix(noteUrl, ap.settings.ServiceURL+"/pub/note/")
+	} else if id, err := ap.db.GetEventIDByNoteURL(ctx, noteUrl); err == nil && id != "" {
+		eventID = id
+	} else {
+		note, err := ap.fetcher.FetchNote(noteUrl)
+		if err != nil {
+			return nil, err
+		}
+		return ap.NoteToEvent(ctx, note)
+	}
+
+	event, err := ap.nostr.GetEventByID(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if event == nil {
+		return nil, fmt.Errorf("reacted event %s not found", eventID)
+	}
+
+	return event, nil
+}
+
+// AcceptFollow lets the follower's server know that the follow of one of our actors went through,
+// otherwise it will be shown as pending forever.
+func (ap *ActivityPub) AcceptFollow(ctx context.Context, follow litepub.Follow) error {
+	follower, err := ap.fetcher.FetchActor(follow.Actor)
+	if err != nil {
+		return err
+	}
+
+	if err := ap.db.SaveActor(ctx, follower); err != nil {
+		log.Warn().Err(err).Str("actor", follower.Id).Msg("fail to save follower")
+	}
+
+	// relays follow the public collection, which can't be the one accepting
+	actorUrl := follow.Object
+	if isRelayFollow(actorUrl, ap.settings) {
+		actorUrl = ap.settings.ServiceURL + "/pub/instance"
+	}
+
+	accept := litepub.Create[litepub.Follow]{
+		Base: litepub.Base{
+			Type: "Accept",
+			Id:   fmt.Sprintf("%s/pub/accept/%x", ap.settings.ServiceURL, sha256.Sum256([]byte(follow.Id+follow.Actor))),
+		},
+		Actor:  actorUrl,
+		Object: follow,
+	}
+
+	return ap.deliver(ctx, actorUrl, follower.Inbox, accept)
+}
+
+// RejectFollow tells a follower we won't honor its follow. It is sent on behalf of the followed actor when it is
+// one of ours, and of the instance actor otherwise.
+func (ap *ActivityPub) RejectFollow(ctx context.Context, follow litepub.Follow) error {
+	follower, err := ap.fetcher.FetchActor(follow.Actor)
+	if err != nil {
+		return err
+	}
+
+	actorUrl := follow.Object
+	if !strings.HasPrefix(actorUrl, ap.settings.ServiceURL+"/pub/user/") || !isPubKeyHex(strings.TrimPrefix(actorUrl, ap.settings.ServiceURL+"/pub/user/")) {
+		actorUrl = ap.settings.ServiceURL + "/pub/instance"
+	}
+
+	reject := litepub.Create[litepub.Follow]{
+		Base: litepub.Base{
+			Type: "Reject",
+			Id:   fmt.Sprintf("%s/pub/reject/%x", ap.settings.ServiceURL, sha256.Sum256([]byte(follow.Id+follow.Actor))),
+		},
+		Actor:  actorUrl,
+		Object: follow,
+	}
+
+	return ap.deliver(ctx, actorUrl, follower.DeliveryInbox(), reject)
+}
+
+// FollowRemote follows a fediverse actor on behalf of a nostr user, the answer comes later to the inbox.
+func (ap *ActivityPub) FollowRemote(ctx context.Context, nostrPubkey string, targetActorUrl string) error {
+	target, err := ap.fetcher.FetchActor(targetActorUrl)
+	if err != nil {
+		return err
+	}
+
+	actorUrl := ap.settings.ServiceURL + "/pub/user/" + nostrPubkey
+	follow := litepub.Follow{
+		Base: litepub.Base{
+			Type: "Follow",
+			Id:   fmt.Sprintf("%s/pub/follow/%x", ap.settings.ServiceURL, sha256.Sum256([]byte(fmt.Sprintf("%s %s %d", nostrPubkey, target.Id, time.Now().UnixNano())))),
+		},
+		Actor:  actorUrl,
+		Object: target.Id,
+	}
+
+	if err := ap.db.SaveRemoteFollow(ctx, nostrPubkey, target.Id, follow.Id); err != nil {
+		return err
+	}
+
+	return ap.deliver(ctx, actorUrl, target.DeliveryInbox(), follow)
+}
+
+// UnfollowRemote undoes a previous FollowRemote.
+func (ap *ActivityPub) UnfollowRemote(ctx context.Context, nostrPubkey string, targetActorUrl string) error {
+	followId, err := ap.db.DeleteRemoteFollow(ctx, nostrPubkey, targetActorUrl)
+	if err != nil {
+		return err
+	}
+
+	target, err := ap.fetcher.FetchActor(targetActorUrl)
+	if err != nil {
+		return err
+	}
+
+	actorUrl := ap.settings.ServiceURL + "/pub/user/" + nostrPubkey
+	undo := litepub.Create[litepub.Follow]{
+		Base: litepub.Base{
+			Type: "Undo",
+			Id:   followId + "/undo",
+		},
+		Actor: actorUrl,
+		Object: litepub.Follow{
+			Base:   litepub.Base{Type: "Follow", Id: followId},
+			Actor:  actorUrl,
+			Object: targetActorUrl,
+		},
+	}
+
+	return ap.deliver(ctx, actorUrl, target.DeliveryInbox(), undo)
+}
+
+// SyncFollows makes the fediverse follows of a nostr user match its contact list: the bridged actors it
+// follows are followed from its bridged actor, and those it stopped following are unfollowed.
+func (ap *ActivityPub) SyncFollows(ctx context.Context, contactList nostr.Event) error {
+	followed, err := ap.db.GetRemoteFollows(ctx, contactList.PubKey)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for _, tag := range contactList.Tags.GetAll([]string{"p"}) {
+		actorUrl, err := ap.db.GetActorURLByPubKey(ctx, tag.Value())
+		if err != nil || actorUrl == "" {
+			// not someone we bridge from the fediverse
+			continue
+		}
+		wanted[actorUrl] = true
+
+		if !slices.Contains(followed, actorUrl) {
+			if err := ap.FollowRemote(ctx, contactList.PubKey, actorUrl); err != nil {
+				log.Warn().Err(err).Str("pubkey", contactList.PubKey).Str("actor", actorUrl).Msg("failed to follow remote actor")
+			}
+		}
+	}
+
+	for _, actorUrl := range followed {
+		if !wanted[actorUrl] {
+			if err := ap.UnfollowRemote(ctx, contactList.PubKey, actorUrl); err != nil {
+				log.Warn().Err(err).Str("pubkey", contactList.PubKey).Str("actor", actorUrl).Msg("failed to unfollow remote actor")
+			}
+		}
+	}
+
+	return nil
+}
+
+// deliver queues an activity to be POSTed to a remote inbox, signed on behalf of one of our actors.
+func (ap *ActivityPub) deliver(ctx context.Context, actorUrl string, inbox string, activity interface{}) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	return ap.db.EnqueueDelivery(ctx, inbox, actorUrl+"#main-key", body)
+}
+
+// noteLanguage picks the language and content to bridge from a note's contentMap: the one matching its content,
+// or failing that our default language, or failing that whichever comes first alphabetically.
+func (ap *ActivityPub) noteLanguage(note *Note) (string, string) {
+	if len(note.ContentMap) == 0 {
+		return "", note.Content
+	}
+
+	languages := make([]string, 0, len(note.ContentMap))
+	for lang, content := range note.ContentMap {
+		if content == note.Content {
+			return lang, content
+		}
+		languages = append(languages, lang)
+	}
+
+	if content, ok := note.ContentMap[ap.settings.DefaultLanguage]; ok {
+		return ap.settings.DefaultLanguage, content
+	}
+
+	sort.Strings(languages)
+	return languages[0], note.ContentMap[languages[0]]
+}
+
+// isShortcode tells whether s can be used as a NIP-30 emoji shortcode, which only allows alphanumerics and underscores.
+func isShortcode(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ArticleToEvent converts a long-form fediverse article into a NIP-23 event, addressed by the article's URL so
+// that updates to it replace the previous version.
+func (ap *ActivityPub) ArticleToEvent(ctx context.Context, article *Note) (*nostr.Event, error) {
+	ctx, span := tracer.Start(ctx, "ActivityPub.ArticleToEvent", trace.WithAttributes(attribute.String("article", article.Id)))
+	defer span.End()
+
+	privkey, pubkey, err := ap.nostr.GetNostrKeysByActor(ctx, article.AttributedTo)
+	if err != nil {
+		return nil, err
+	}
+
+	_, content := ap.noteLanguage(article)
+	tags := nostr.Tags{
+		{"d", article.Id},
+		{"title", article.Name},
+		{"published_at", strconv.FormatInt(article.Published.Unix(), 10)},
+	}
+	if article.Summary != "" {
+		tags = append(tags, nostr.Tag{"summary", article.Summary})
+	}
+
+	event := nostr.Event{
+		CreatedAt: time.Now(),
+		PubKey:    pubkey,
+		Tags:      tags,
+		Kind:      30023,
+		Content:   htmlToText(content, "markdown"),
+	}
+
+	if err := event.Sign(privkey); err != nil {
+		log.Warn().Err(err).Interface("evt", event).Msg("fail to sign an event")
+	}
+	conversions.Inc("article_to_event")
+
+	tasks.Go(func() {
+		if err := ap.db.SaveNote(context.Background(), event.ID, event.PubKey, article.Id); err != nil {
+			log.Warn().Err(err).Msg("fail to save article")
+		}
+	})
 
 	return &event, nil
 }
+
+// pollOptions lists the options of a poll below its question, as there are no polls on nostr to turn it into.
+func pollOptions(note *Note) string {
+	options, bullet := note.OneOf, "○"
+	if len(options) == 0 {
+		options, bullet = note.AnyOf, "☐"
+	}
+	if len(options) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("\n")
+	for _, option := range options {
+		b.WriteString("\n" + bullet + " " + strip.StripTags(option.Name))
+	}
+	return b.String()
+}
+
+// contentWarningPrefix is what we put in front of a bridged note's content when it has a content warning.
+func contentWarningPrefix(warning string) string {
+	return "CW: " + warning + "\n\n"
+}
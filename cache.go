@@ -1,62 +1,118 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 )
 
 type CacheProvider interface {
-	SetPurgeFrequency(duration time.Duration)
+	SetPurgeFrequency(ctx context.Context, duration time.Duration)
+	Purge(ctx context.Context) (int64, error)
 	GetNoteByID(id string) (*nostr.Event, error)
-	GetNotesByPubKey(pubkey string) ([]nostr.Event, error)
+	GetNotesByPubKey(pubkey string, until *time.Time, limit int) ([]nostr.Event, error)
+	CountNotesByPubKey(pubkey string) (int, error)
 	GetMetadata(pubkey string) (*nostr.Event, error)
 	GetContactList(pubkey string) (*nostr.Event, error)
 	GetEventByKey(key string) (*nostr.Event, error)
+	GetStaleEventByKey(key string) (*nostr.Event, error)
+	GetActorID(actorUrl string) (string, error)
+	CacheActorID(actorUrl string, id string) error
+	IsGone(url string) (bool, error)
+	CacheGone(url string, ttl time.Duration) error
 	CacheEvent(nostr.Event) error
+	CacheEvents([]nostr.Event) error
 	ClearCacheByKey(key string) error
+	WriteMetrics(w io.Writer)
 }
 
 type PostgresCache struct {
-	conn *sqlx.DB
+	conn      *sqlx.DB
+	hits      *counterVec
+	misses    *counterVec
+	lastPurge *gauge
 }
 
-func NewPostgresCache(dbUrl string) CacheProvider {
-	conn, err := sqlx.Connect("postgres", dbUrl)
-	if err != nil {
-		panic(err)
-	}
-
+func NewPostgresCache(conn *sqlx.DB) CacheProvider {
 	return &PostgresCache{
 		conn,
+		newCounterVec("nofed_cache_hits_total", "Cache lookups that found an entry.", "kind"),
+		newCounterVec("nofed_cache_misses_total", "Cache lookups that found nothing.", "kind"),
+		newGauge("nofed_cache_last_purge_timestamp_seconds", "When the cache was last purged successfully."),
 	}
 }
 
-// SetPurgeFrequency needs to be run as a goroutine to asynchronously clean out old cache items
-func (p *PostgresCache) SetPurgeFrequency(duration time.Duration) {
+// SetPurgeFrequency needs to be run as a goroutine to asynchronously clean out old cache items,
+// it returns once ctx is cancelled. A failed sweep is logged and the next one tried all the same.
+func (p *PostgresCache) SetPurgeFrequency(ctx context.Context, duration time.Duration) {
+	ticker := time.NewTicker(duration)
+	defer ticker.Stop()
+
 	for {
-		time.Sleep(duration)
-		p.conn.Exec("DELETE FROM cache WHERE expiration < $1", time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := p.Purge(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error().Err(err).Msg("failed to purge cache")
+				}
+				continue
+			}
+			log.Debug().Int64("deleted", deleted).Msg("purged cache")
+		}
 	}
 }
 
+// Purge deletes the expired cache entries, gone tombstones included, and the canonical ids of actors we no
+// longer have keys for, returning how many entries went away.
+func (p *PostgresCache) Purge(ctx context.Context) (int64, error) {
+	expired, err := p.conn.ExecContext(ctx, "DELETE FROM cache WHERE expiration < $1", time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	orphaned, err := p.conn.ExecContext(ctx, `
+        DELETE FROM cache
+        WHERE key LIKE 'actor:%'
+        AND NOT EXISTS (SELECT 1 FROM keys WHERE keys.pub_actor_url = cache.value)`)
+	if err != nil {
+		return 0, err
+	}
+
+	p.lastPurge.Set(time.Now().Unix())
+
+	expiredRows, _ := expired.RowsAffected()
+	orphanedRows, _ := orphaned.RowsAffected()
+	return expiredRows + orphanedRows, nil
+}
+
 func (p *PostgresCache) GetNoteByID(id string) (*nostr.Event, error) {
-	return p.GetEventByKey(fmt.Sprintf("1:%s", id))
+	return p.GetEventByKey(noteKey(id))
 }
 
-func (p *PostgresCache) GetNotesByPubKey(pubkey string) ([]nostr.Event, error) {
+// GetNotesByPubKey returns the limit newest cached notes from pubkey, only those no newer than until if it is given,
+// the way relays read until.
+func (p *PostgresCache) GetNotesByPubKey(pubkey string, until *time.Time, limit int) ([]nostr.Event, error) {
 	var blobs []string
 	if err := p.conn.Select(&blobs, `
 		SELECT value FROM cache
-        WHERE key LIKE '1:' || $1 || '%'
+        WHERE key LIKE '1:' || $1 || ':%'
+        AND (expiration IS NULL OR expiration > now())
+        AND ($2::timestamp IS NULL OR time <= $2)
         ORDER BY time DESC
-        LIMIT 100`, fmt.Sprintf("1:%s:%%", pubkey)); err != nil {
+        LIMIT $3`, pubkey, until, limit); err != nil {
 		return nil, err
 	}
+	p.record("1:", len(blobs) > 0)
 
 	var events []nostr.Event
 	for _, blob := range blobs {
@@ -70,21 +126,40 @@ func (p *PostgresCache) GetNotesByPubKey(pubkey string) ([]nostr.Event, error) {
 	return events, nil
 }
 
+// CountNotesByPubKey returns how many notes from pubkey we have cached.
+func (p *PostgresCache) CountNotesByPubKey(pubkey string) (int, error) {
+	var count int
+	err := p.conn.Get(&count, "SELECT count(*) FROM cache WHERE key LIKE '1:' || $1 || ':%'", pubkey)
+	return count, err
+}
+
 func (p *PostgresCache) GetMetadata(pubkey string) (*nostr.Event, error) {
-	return p.GetEventByKey(fmt.Sprintf("0:%s", pubkey))
+	return p.GetEventByKey(metadataKey(pubkey))
 }
 
 func (p *PostgresCache) GetContactList(pubkey string) (*nostr.Event, error) {
-	return p.GetEventByKey(fmt.Sprintf("3:%s", pubkey))
+	return p.GetEventByKey(contactListKey(pubkey))
 }
 
+// GetEventByKey returns the cached event stored under key, as long as it hasn't expired yet.
 func (p *PostgresCache) GetEventByKey(key string) (*nostr.Event, error) {
+	return p.getEvent("SELECT value FROM cache WHERE key = $1 AND (expiration IS NULL OR expiration > now())", key)
+}
+
+// GetStaleEventByKey returns the cached event stored under key even if it has already expired,
+// which is still better than nothing when the relays can't give us a fresh copy.
+func (p *PostgresCache) GetStaleEventByKey(key string) (*nostr.Event, error) {
+	return p.getEvent("SELECT value FROM cache WHERE key = $1", key)
+}
+
+func (p *PostgresCache) getEvent(query string, key string) (*nostr.Event, error) {
 	var value string
-	err := p.conn.Get(&value, "SELECT value FROM cache WHERE key = $1", key)
+	err := p.conn.Get(&value, query, key)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
 
+	p.record(key, value != "")
 	if value == "" {
 		return nil, nil
 	}
@@ -97,48 +172,177 @@ func (p *PostgresCache) GetEventByKey(key string) (*nostr.Event, error) {
 	return &event, nil
 }
 
+// GetActorID returns the canonical actor id previously resolved for actorUrl, if any.
+func (p *PostgresCache) GetActorID(actorUrl string) (string, error) {
+	var id string
+	err := p.conn.Get(&id, "SELECT value FROM cache WHERE key = $1 AND (expiration IS NULL OR expiration > now())", actorKey(actorUrl))
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	p.record(actorKey(actorUrl), id != "")
+	return id, nil
+}
+
+func (p *PostgresCache) CacheActorID(actorUrl string, id string) error {
+	_, err := p.conn.Exec(`
+        INSERT INTO cache (key, value, time, expiration)
+        VALUES ($1, $2, now(), now() + interval '10 days')
+        ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, time = EXCLUDED.time, expiration = EXCLUDED.expiration
+    `, actorKey(actorUrl), id)
+	return err
+}
+
+// IsGone tells whether fetching url recently failed for good, see CacheGone.
+func (p *PostgresCache) IsGone(url string) (bool, error) {
+	var gone bool
+	err := p.conn.Get(&gone, "SELECT true FROM cache WHERE key = $1 AND expiration > now()", goneKey(url))
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	p.record(goneKey(url), gone)
+	return gone, nil
+}
+
+// CacheGone records that url is gone or unreachable, so that it isn't fetched again for ttl.
+func (p *PostgresCache) CacheGone(url string, ttl time.Duration) error {
+	_, err := p.conn.Exec(`
+        INSERT INTO cache (key, value, time, expiration)
+        VALUES ($1, '', now(), $2)
+        ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, time = EXCLUDED.time, expiration = EXCLUDED.expiration
+    `, goneKey(url), time.Now().Add(ttl))
+	return err
+}
+
 func (p *PostgresCache) CacheEvent(event nostr.Event) error {
-	value, err := json.Marshal(event)
+	return p.CacheEvents([]nostr.Event{event})
+}
+
+// CacheEvents stores a batch of events using a single transaction and prepared statement,
+// so caching a whole page of notes doesn't cost one round-trip per key.
+func (p *PostgresCache) CacheEvents(events []nostr.Event) error {
+	tx, err := p.conn.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Preparex(`
+        INSERT INTO cache (key, value, time, expiration)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, time = EXCLUDED.time, expiration = EXCLUDED.expiration
+    `)
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
 
-	var keys []string
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		keys, err := cacheKeys(event)
+		if err != nil {
+			return err
+		}
+
+		// events that expire (NIP-40) are only kept until then
+		expiration := time.Now().Add(10 * 24 * time.Hour)
+		if expires := eventExpiration(event); expires != nil && expires.Before(expiration) {
+			expiration = *expires
+		}
+
+		for _, key := range keys {
+			if _, err := stmt.Exec(key, value, event.CreatedAt, expiration); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func cacheKeys(event nostr.Event) ([]string, error) {
 	switch event.Kind {
 	case 0:
 		// metadata
-		keys = []string{
-			fmt.Sprintf("0:%s", event.PubKey),
-		}
+		return []string{
+			metadataKey(event.PubKey),
+		}, nil
 	case 1:
 		// note
-		keys = []string{
-			fmt.Sprintf("1:%s", event.ID),
+		return []string{
+			noteKey(event.ID),
 			fmt.Sprintf("1:%s:%s", event.PubKey, event.ID),
-		}
+		}, nil
+	case 30023:
+		// long-form article, only ever looked up by id
+		return []string{
+			noteKey(event.ID),
+		}, nil
 	case 3:
 		// contact list
-		keys = []string{
-			fmt.Sprintf("3:%s", event.PubKey),
-		}
+		return []string{
+			contactListKey(event.PubKey),
+		}, nil
 	default:
-		return fmt.Errorf("unknown event kind: %d", event.Kind)
+		return nil, fmt.Errorf("unknown event kind: %d", event.Kind)
 	}
+}
 
-	for _, key := range keys {
-		if _, err := p.conn.Exec(`
-            INSERT INTO cache (key, value, time, expiration)
-            VALUES ($1, $2, $3, now() + interval '10 days')
-            ON CONFLICT (key) DO UPDATE SET expiration = EXCLUDED.expiration
-        `, key, value, event.CreatedAt); err != nil {
-			return err
-		}
+// record counts a hit or a miss for the kind of entry the key refers to.
+func (p *PostgresCache) record(key string, hit bool) {
+	kind := "other"
+	switch {
+	case strings.HasPrefix(key, "0:"):
+		kind = "metadata"
+	case strings.HasPrefix(key, "1:"):
+		kind = "note"
+	case strings.HasPrefix(key, "3:"):
+		kind = "contacts"
+	case strings.HasPrefix(key, "actor:"):
+		kind = "actor"
+	case strings.HasPrefix(key, "gone:"):
+		kind = "gone"
 	}
 
-	return nil
+	if hit {
+		p.hits.Inc(kind)
+	} else {
+		p.misses.Inc(kind)
+	}
+}
+
+func (p *PostgresCache) WriteMetrics(w io.Writer) {
+	p.hits.Write(w)
+	p.misses.Write(w)
+	p.lastPurge.Write(w)
+}
+
+func noteKey(id string) string {
+	return fmt.Sprintf("1:%s", id)
+}
+
+func metadataKey(pubkey string) string {
+	return fmt.Sprintf("0:%s", pubkey)
+}
+
+func contactListKey(pubkey string) string {
+	return fmt.Sprintf("3:%s", pubkey)
+}
+
+func actorKey(actorUrl string) string {
+	return fmt.Sprintf("actor:%s", actorUrl)
+}
+
+func goneKey(url string) string {
+	return fmt.Sprintf("gone:%s", url)
 }
 
 func (p *PostgresCache) ClearCacheByKey(key string) error {
-	_, err := p.conn.Exec("DELETE FROM cache WHERE key = $1", fmt.Sprintf("1:%s", key))
+	_, err := p.conn.Exec("DELETE FROM cache WHERE key = $1", key)
 	return err
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+func TestGetNotesByPubKeyOnlyMatchesTheAuthorKeys(t *testing.T) {
+	cache := NewPostgresCache(testDatabase(t))
+
+	author := "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	other := "c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5"
+
+	// cached under 1:<id> too, which starts like the other pubkey's keys would
+	note := nostr.Event{
+		ID:        other + "00",
+		PubKey:    author,
+		Kind:      1,
+		CreatedAt: time.Now(),
+		Content:   "hello",
+	}
+	if err := cache.CacheEvent(note); err != nil {
+		t.Fatalf("CacheEvent: %v", err)
+	}
+
+	notes, err := cache.GetNotesByPubKey(author, nil, 10)
+	if err != nil {
+		t.Fatalf("GetNotesByPubKey: %v", err)
+	}
+	if len(notes) != 1 || notes[0].ID != note.ID {
+		t.Errorf("got %d notes for the author, want just %s", len(notes), note.ID)
+	}
+
+	notes, err = cache.GetNotesByPubKey(other, nil, 10)
+	if err != nil {
+		t.Fatalf("GetNotesByPubKey: %v", err)
+	}
+	if len(notes) != 0 {
+		t.Errorf("got %d notes for another pubkey, want none", len(notes))
+	}
+}
+
+func TestCacheKeys(t *testing.T) {
+	for _, test := range []struct {
+		event nostr.Event
+		want  []string
+	}{
+		{nostr.Event{ID: "e1", PubKey: "p1", Kind: 0}, []string{"0:p1"}},
+		{nostr.Event{ID: "e1", PubKey: "p1", Kind: 1}, []string{"1:e1", "1:p1:e1"}},
+		{nostr.Event{ID: "e1", PubKey: "p1", Kind: 3}, []string{"3:p1"}},
+		{nostr.Event{ID: "e1", PubKey: "p1", Kind: 30023}, []string{"1:e1"}},
+	} {
+		keys, err := cacheKeys(test.event)
+		if err != nil {
+			t.Fatalf("kind %d: %v", test.event.Kind, err)
+		}
+		if !slices.Equal(keys, test.want) {
+			t.Errorf("kind %d: got keys %v, want %v", test.event.Kind, keys, test.want)
+		}
+	}
+
+	if _, err := cacheKeys(nostr.Event{Kind: 7}); err == nil {
+		t.Error("expected an error for a kind we don't cache")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DeliveryWorker POSTs the activities waiting in the delivery queue to their target inboxes,
+// retrying with exponential backoff so that temporarily unavailable instances still get them.
+type DeliveryWorker struct {
+	client   *http.Client
+	db       StorageProvider
+	policy   *FederationPolicy
+	settings Settings
+}
+
+func NewDeliveryWorker(client *http.Client, db StorageProvider, policy *FederationPolicy, settings Settings) *DeliveryWorker {
+	return &DeliveryWorker{
+		client,
+		db,
+		policy,
+		settings,
+	}
+}
+
+// Run processes the queue until ctx is cancelled.
+func (d *DeliveryWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.processDue(ctx)
+		}
+	}
+}
+
+func (d *DeliveryWorker) processDue(ctx context.Context) {
+	deliveries, err := d.db.ClaimDueDeliveries(ctx, 20, time.Minute)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to claim due deliveries")
+		return
+	}
+
+	for _, delivery := range deliveries {
+		if !d.policy.AllowsURL(delivery.TargetInbox) {
+			log.Info().Str("inbox", delivery.TargetInbox).Msg("dropping delivery to a domain we don't federate with")
+			if err := d.db.RemoveDelivery(ctx, delivery.ID); err != nil {
+				log.Warn().Err(err).Int64("id", delivery.ID).Msg("failed to update delivery queue")
+			}
+			continue
+		}
+
+		err := d.deliver(ctx, delivery)
+		switch {
+		case err == nil:
+			err = d.db.RemoveDelivery(ctx, delivery.ID)
+		case delivery.Attempts >= d.settings.DeliveryMaxAttempts:
+			log.Warn().Err(err).Str("inbox", delivery.TargetInbox).Int("attempts", delivery.Attempts).Msg("giving up on delivery")
+			err = d.db.RemoveDelivery(ctx, delivery.ID)
+		default:
+			backoff := 30 * time.Second << (delivery.Attempts - 1)
+			log.Debug().Err(err).Str("inbox", delivery.TargetInbox).Dur("backoff", backoff).Msg("delivery failed, will retry")
+			err = d.db.RescheduleDelivery(ctx, delivery.ID, time.Now().Add(backoff))
+		}
+
+		if err != nil {
+			log.Warn().Err(err).Int64("id", delivery.ID).Msg("failed to update delivery queue")
+		}
+	}
+}
+
+func (d *DeliveryWorker) deliver(ctx context.Context, delivery Delivery) error {
+	body := []byte(delivery.ActivityJSON)
+	r, err := http.NewRequestWithContext(ctx, "POST", delivery.TargetInbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Content-Type", "application/activity+json")
+	if err := signRequest(r, d.signingKey(delivery.KeyID), delivery.KeyID, body); err != nil {
+		return err
+	}
+
+	resp, err := d.client.Do(r)
+	if err != nil {
+		deliveryResults.Inc("error")
+		return err
+	}
+	defer resp.Body.Close()
+
+	deliveryResults.Inc(deliveryResult(resp.StatusCode))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("delivery to %s failed with status %d", delivery.TargetInbox, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// signingKey picks the private key matching one of our actors' key ids.
+func (d *DeliveryWorker) signingKey(keyId string) crypto.Signer {
+	if strings.HasPrefix(keyId, d.settings.ServiceURL+"/pub/instance#") {
+		return d.settings.InstancePrivateKey
+	}
+
+	return d.settings.PrivateKey
+}
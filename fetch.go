@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fiatjaf/litepub"
+	"io"
+	"net/http"
+	"time"
+)
+
+type FetchProvider interface {
+	FetchActor(url string) (*Actor, error)
+	FetchNote(url string) (*Note, error)
+	FetchNotes(outboxUrl string, since *time.Time) ([]Note, error)
+	FetchFollowing(url string) ([]string, error)
+	FetchFeatured(url string) ([]Note, error)
+}
+
+type Fetcher struct {
+	client   *http.Client
+	cache    CacheProvider
+	policy   *FederationPolicy
+	settings Settings
+}
+
+func NewFetcher(client *http.Client, cache CacheProvider, policy *FederationPolicy, settings Settings) FetchProvider {
+	return &Fetcher{
+		client,
+		cache,
+		policy,
+		settings,
+	}
+}
+
+func (f *Fetcher) FetchActor(url string) (*Actor, error) {
+	var actor Actor
+	err := f.requestUnlessGone(url, &actor)
+	return &actor, err
+}
+
+func (f *Fetcher) FetchNote(url string) (*Note, error) {
+	var note Note
+	err := f.requestUnlessGone(url, &note)
+	return &note, err
+}
+
+// FetchNotes returns the notes created in an actor's outbox, ignoring any other kind of activity. It follows the
+// outbox's pages back in time, up to OutboxFetchPages of them and OutboxFetchItems activities in all, and no
+// further than since if it is given.
+func (f *Fetcher) FetchNotes(outboxUrl string, since *time.Time) ([]Note, error) {
+	var reachedSince func(json.RawMessage) bool
+	if since != nil {
+		reachedSince = func(item json.RawMessage) bool {
+			var activity struct {
+				Published time.Time `json:"published"`
+			}
+			return json.Unmarshal(item, &activity) == nil && !activity.Published.IsZero() && activity.Published.Before(*since)
+		}
+	}
+
+	items, err := f.fetchCollection(outboxUrl, f.settings.OutboxFetchItems, f.settings.OutboxFetchPages, reachedSince)
+	if err != nil {
+		return nil, err
+	}
+
+	var notes []Note
+	for _, item := range items {
+		var create litepub.Create[Note]
+		if err := json.Unmarshal(item, &create); err != nil {
+			continue
+		}
+
+		if create.Type == "Create" && isNoteType(create.Object.Type) {
+			notes = append(notes, create.Object)
+		}
+	}
+
+	return notes, nil
+}
+
+func (f *Fetcher) FetchFollowing(url string) ([]string, error) {
+	items, err := f.fetchCollection(url, 400, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	following := make([]string, 0, len(items))
+	for _, item := range items {
+		if id := objectID(item); id != "" {
+			following = append(following, id)
+		}
+	}
+
+	return following, nil
+}
+
+// FetchFeatured returns the notes an actor has pinned, which may be given inline or just by their URLs.
+func (f *Fetcher) FetchFeatured(url string) ([]Note, error) {
+	items, err := f.fetchCollection(url, 20, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var notes []Note
+	for _, item := range items {
+		var note Note
+		if err := json.Unmarshal(item, &note); err != nil || note.Id == "" {
+			fetched, err := f.FetchNote(objectID(item))
+			if err != nil {
+				continue
+			}
+			note = *fetched
+		}
+
+		if isNoteType(note.Type) {
+			notes = append(notes, note)
+		}
+	}
+
+	return notes, nil
+}
+
+// fetchCollection walks an (ordered) collection page by page, returning up to limit raw items from at most
+// maxPages pages, or as many as it takes if maxPages is 0. When given, last tells whether an item is the last
+// one worth a next page, as in outboxes going back in time past what we're after.
+func (f *Fetcher) fetchCollection(url string, limit int, maxPages int, last func(json.RawMessage) bool) ([]json.RawMessage, error) {
+	type page struct {
+		litepub.Base
+		OrderedItems []json.RawMessage `json:"orderedItems"`
+		Items        []json.RawMessage `json:"items"`
+		Next         string            `json:"next"`
+	}
+
+	var collection struct {
+		page
+		First json.RawMessage `json:"first"`
+	}
+	if err := f.request(url, &collection); err != nil {
+		return nil, err
+	}
+
+	// small collections may hold their items themselves, otherwise "first" is either a page object or just its URL
+	var current page
+	if len(collection.First) == 0 {
+		current = collection.page
+	} else if err := json.Unmarshal(collection.First, &current); err != nil || current.Id == "" {
+		var pageUrl string
+		if err := json.Unmarshal(collection.First, &pageUrl); err != nil || pageUrl == "" {
+			return nil, nil
+		}
+
+		if err := f.request(pageUrl, &current); err != nil {
+			return nil, err
+		}
+	}
+
+	var items []json.RawMessage
+	for pages := 1; ; pages++ {
+		items = append(items, current.OrderedItems...)
+		items = append(items, current.Items...)
+
+		if len(items) >= limit || current.Next == "" || len(current.OrderedItems)+len(current.Items) == 0 {
+			break
+		}
+		if maxPages > 0 && pages >= maxPages {
+			break
+		}
+		if last != nil && len(items) > 0 && last(items[len(items)-1]) {
+			break
+		}
+
+		var next page
+		if err := f.request(current.Next, &next); err != nil {
+			// return what we got so far
+			break
+		}
+		current = next
+	}
+
+	if len(items) > limit {
+		items = items[:limit]
+	}
+
+	return items, nil
+}
+
+// errNotFederated is returned for URLs on domains the federation policy doesn't allow.
+var errNotFederated = errors.New("we don't federate with its domain")
+
+// errGone is returned for documents that were deleted or whose server we can't reach.
+var errGone = errors.New("gone or unreachable")
+
+// requestUnlessGone is request for documents that get asked for over and over, like popular actors: once one
+// turns out to be gone it isn't fetched again for a while, sparing us and its server the failing requests.
+func (f *Fetcher) requestUnlessGone(url string, result interface{}) error {
+	if gone, err := f.cache.IsGone(url); err == nil && gone {
+		return fmt.Errorf("not fetching %s: %w", url, errGone)
+	}
+
+	err := f.request(url, result)
+	if errors.Is(err, errGone) {
+		if err := f.cache.CacheGone(url, f.settings.GoneTTL); err != nil {
+			log.Warn().Err(err).Str("url", url).Msg("failed to cache gone document")
+		}
+	}
+
+	return err
+}
+
+// request GETs an ActivityPub document. Instances running in "secure mode" refuse unsigned requests,
+// so when that happens the request is retried with a signature from our instance actor.
+func (f *Fetcher) request(url string, result interface{}) error {
+	if !f.policy.AllowsURL(url) {
+		return fmt.Errorf("not fetching %s: %w", url, errNotFederated)
+	}
+
+	resp, err := f.get(url, false)
+	if err != nil {
+		return fmt.Errorf("fetching %s failed (%s): %w", url, err, errGone)
+	}
+
+	if resp.StatusCode == 401 || resp.StatusCode == 403 {
+		resp.Body.Close()
+		if resp, err = f.get(url, true); err != nil {
+			return fmt.Errorf("fetching %s failed (%s): %w", url, err, errGone)
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 || resp.StatusCode == 410 {
+		return fmt.Errorf("fetching %s failed with status %d: %w", url, resp.StatusCode, errGone)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("fetching %s failed with status %d", url, resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, result); err != nil {
+		str := string(b)
+		if len(str) > 100 {
+			str = str[:100] + "..."
+		}
+		return fmt.Errorf("error unmarshaling %s (\"%s\"): %w", url, str, err)
+	}
+
+	return nil
+}
+
+func (f *Fetcher) get(url string, signed bool) (*http.Response, error) {
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Header.Set("Accept", `application/activity+json, application/ld+json; profile="https://www.w3.org/ns/activitystreams"`)
+	if signed {
+		if err := signRequest(r, f.settings.InstancePrivateKey, f.settings.ServiceURL+"/pub/instance#main-key", nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return f.client.Do(r)
+}
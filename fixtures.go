@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Fixtures stand in for the nostr relays and the fediverse when running with MODE=test, so that the whole
+// HTTP surface can be exercised without reaching out to anyone. They are read from a JSON file like:
+//
+//	{
+//	  "events": [{"id": "...", "pubkey": "...", "kind": 1, ...}],
+//	  "documents": {"https://example.com/users/alice": {"type": "Person", ...}}
+//	}
+type Fixtures struct {
+	mu sync.Mutex
+
+	// Events are what the relays hold, events we publish are added to them
+	Events []nostr.Event `json:"events"`
+	// Documents are the ActivityPub documents served for each URL
+	Documents map[string]json.RawMessage `json:"documents"`
+}
+
+func loadFixtures(path string) (*Fixtures, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixtures Fixtures
+	if err := json.Unmarshal(b, &fixtures); err != nil {
+		return nil, err
+	}
+
+	return &fixtures, nil
+}
+
+// Query returns the newest max events matching filter, as relays would.
+func (f *Fixtures) Query(filter nostr.Filter, max int) []nostr.Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var events []nostr.Event
+	for _, event := range f.Events {
+		if filter.Matches(&event) && !isExpired(event) {
+			events = append(events, event)
+		}
+	}
+
+	events = rankEvents(events)
+	if len(events) > max {
+		events = events[:max]
+	}
+
+	return events
+}
+
+func (f *Fixtures) Publish(event nostr.Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Events = append(f.Events, event)
+}
+
+// RoundTrip serves GETs from the documents and accepts any POST, which is all we do with remote servers.
+func (f *Fixtures) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil {
+		_ = r.Body.Close()
+	}
+
+	status, body := http.StatusNotFound, []byte(`{"error":"not found"}`)
+	switch r.Method {
+	case "GET":
+		f.mu.Lock()
+		document, ok := f.Documents[r.URL.String()]
+		f.mu.Unlock()
+		if ok {
+			status, body = http.StatusOK, document
+		}
+	case "POST":
+		log.Debug().Str("url", r.URL.String()).Msg("accepting delivery in test mode")
+		status, body = http.StatusAccepted, nil
+	}
+
+	return &http.Response{
+		Status:        http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/activity+json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}, nil
+}
@@ -1,63 +1,239 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"github.com/fiatjaf/litepub"
 	"github.com/gorilla/mux"
+	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip05"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slices"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type HandlerResponse func(w http.ResponseWriter, r *http.Request)
 
+// instanceActorName is the account name under which the bridge's own actor can be found through webfinger.
+const instanceActorName = "instance"
+
 type Handler struct {
 	db          StorageProvider
+	cache       CacheProvider
 	nostr       NostrProvider
 	activitypub ActivityPubProvider
+	fetcher     FetchProvider
+	policy      *FederationPolicy
+	broadcast   chan<- nostr.Event
 	settings    Settings
 }
 
-func InitializeHTTPHandlers(db StorageProvider, nostr NostrProvider, activitypub ActivityPubProvider, settings Settings) Handler {
+func InitializeHTTPHandlers(db StorageProvider, cache CacheProvider, nostr NostrProvider, activitypub ActivityPubProvider, fetcher FetchProvider, policy *FederationPolicy, broadcast chan<- nostr.Event, settings Settings) Handler {
 	return Handler{
 		db:          db,
+		cache:       cache,
 		nostr:       nostr,
 		activitypub: activitypub,
+		fetcher:     fetcher,
+		policy:      policy,
+		broadcast:   broadcast,
 		settings:    settings,
 	}
 }
 
+// broadcastEvent hands an event over to the relay so that it reaches its subscribers, and publishes it to the
+// nostr relays so that it reaches everyone else.
+func (h *Handler) broadcastEvent(event nostr.Event) {
+	select {
+	case h.broadcast <- event:
+	default:
+		log.Warn().Str("id", event.ID).Msg("broadcast queue is full, dropping event")
+	}
+
+	tasks.Go(func() {
+		if err := h.nostr.PublishEvent(context.Background(), event); err != nil {
+			log.Warn().Err(err).Str("id", event.ID).Msg("failed to publish event")
+		}
+	})
+}
+
+// notModified sets an ETag derived from what a document is built from, which for documents built from events
+// are their ids, and answers with a 304 if the client already has it. As the events come from the cache, clearing
+// it is enough for the tag to change.
+func notModified(w http.ResponseWriter, r *http.Request, parts ...string) bool {
+	hash := sha256.New()
+	hash.Write([]byte(activityContentType(r)))
+	for _, part := range parts {
+		hash.Write([]byte{0})
+		hash.Write([]byte(part))
+	}
+	etag := fmt.Sprintf(`"%x"`, hash.Sum(nil)[:16])
+
+	w.Header().Set("ETag", etag)
+	w.Header().Add("Vary", "Accept")
+
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+// wantsHTML tells whether the request comes from a browser rather than from an ActivityPub client.
+func wantsHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/html") &&
+		!strings.Contains(accept, "application/activity+json") &&
+		!strings.Contains(accept, "application/ld+json")
+}
+
+// activityContentType picks the ActivityPub media type the client asked for.
+func activityContentType(r *http.Request) string {
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		return `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`
+	}
+
+	return "application/activity+json"
+}
+
 // InboxHandler deals with any incoming ActivityPub to an Inbox and handles them accordingly.
 // This handler will deal with any submissions coming in from the AP side of things.
 // From here we can process any incoming data, store what we need and send anything onwards to our outbox.
-// HTTP: /pub
+// HTTP: /pub, /pub/user/{pubkey}/inbox
 func (h *Handler) InboxHandler() HandlerResponse {
 	return func(w http.ResponseWriter, r *http.Request) {
-		body, _ := io.ReadAll(r.Body)
+		raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.settings.InboxMaxBytes))
+		if err != nil {
+			if int64(len(raw)) >= h.settings.InboxMaxBytes {
+				writeAPError(w, 413, "body too large")
+				log.Info().Str("remote", r.RemoteAddr).Msg("refusing activity over the size limit")
+				return
+			}
+			writeAPError(w, 400, "bad request")
+			log.Info().Err(err).Str("remote", r.RemoteAddr).Msg("failed to read activity")
+			return
+		}
+		body, err := decodeBody(r.Header.Get("Content-Encoding"), raw, h.settings.InboxMaxBytes)
+		if errors.Is(err, errBodyTooLarge) {
+			writeAPError(w, 413, "body too large")
+			log.Info().Str("remote", r.RemoteAddr).Msg("refusing activity over the size limit once decompressed")
+			return
+		}
+		if err != nil {
+			writeAPError(w, 415, "unsupported content encoding")
+			log.Info().Err(err).Str("remote", r.RemoteAddr).Msg("refusing activity we can't decode")
+			return
+		}
+
 		var base litepub.Base
 		if err := json.Unmarshal(body, &base); err != nil {
-			http.Error(w, "bad request", 400)
+			writeAPError(w, 400, "bad request")
 			log.Error().Err(err).Msg("failed to decode request body to base type")
 			return
 		}
+		inboxActivities.Inc(inboxActivityType(base.Type))
+
+		ctx, span := tracer.Start(r.Context(), "InboxHandler", trace.WithAttributes(
+			attribute.String("activity.type", base.Type),
+			attribute.String("activity.id", base.Id),
+		))
+		defer span.End()
+
+		var envelope struct {
+			Actor json.RawMessage `json:"actor"`
+		}
+		_ = json.Unmarshal(body, &envelope)
+		actor := objectID(envelope.Actor)
+		if !h.policy.AllowsURL(actor) {
+			log.Info().Str("actor", actor).Str("type", base.Type).Msg("refusing activity from a domain we don't federate with")
+			writeAPError(w, 403, "forbidden")
+			return
+		}
+
+		// from here on the actor is who the activity says, as only it has the key that signed the request
+		signer, err := h.authenticate(ctx, r, raw, body)
+		if err != nil {
+			writeAPError(w, 401, "invalid signature")
+			log.Info().Err(err).Str("actor", actor).Str("type", base.Type).Msg("refusing activity without a valid signature")
+			return
+		}
+		if signer != actor {
+			writeAPError(w, 401, "signed by someone else")
+			log.Info().Str("actor", actor).Str("signer", signer).Str("type", base.Type).Msg("refusing activity signed by another actor")
+			return
+		}
+
+		// activities posted to an actor's own inbox are for that actor, those posted to /pub for whoever they name
+		recipient := ""
+		if _, ok := mux.Vars(r)["pubkey"]; ok {
+			pubkey, err := pubKeyParam(r)
+			if err != nil {
+				writeAPError(w, 400, err.Error())
+				return
+			}
+			if h.policy.BlocksPubKey(pubkey) {
+				writeAPError(w, 403, "forbidden")
+				return
+			}
+			recipient = pubkey
+		}
+
+		// the same activity gets delivered to several inboxes and retried on timeouts, only handle it once
+		if base.Id != "" {
+			first, err := h.db.MarkActivityProcessed(ctx, base.Id)
+			if err != nil {
+				log.Warn().Err(err).Str("id", base.Id).Msg("failed to record processed activity")
+			} else if !first {
+				log.Debug().Str("id", base.Id).Str("type", base.Type).Msg("activity already processed")
+				w.WriteHeader(200)
+				return
+			} else {
+				// if we fail to handle it the sender will retry, which we want to process again
+				recorder := &statusRecorder{ResponseWriter: w, status: 200}
+				w = recorder
+				defer func() {
+					if recorder.status >= 400 {
+						if err := h.db.ForgetActivity(context.Background(), base.Id); err != nil {
+							log.Warn().Err(err).Str("id", base.Id).Msg("failed to forget activity")
+						}
+					}
+				}()
+			}
+		}
 
 		switch base.Type {
-		case "Create", "Follow":
+		case "Create":
 			var create litepub.Create[litepub.Base]
 			if err := json.Unmarshal(body, &create); err != nil {
-				http.Error(w, "bad request", 400)
+				writeAPError(w, 400, "bad request")
 				log.Error().Err(err).Msg("failed to decode request body to create type")
 				return
 			}
 
-			if key, err := h.db.GetPubKeyByActorUrl(create.Actor); err == nil && err != sql.ErrNoRows {
+			if key, err := h.db.GetPubKeyByActorUrl(ctx, create.Actor); err == nil && err != sql.ErrNoRows {
 				if key == "" {
-					_, _, err = h.nostr.GetNostrKeysByActor(create.Actor)
+					_, _, err = h.nostr.GetNostrKeysByActor(ctx, create.Actor)
 					if err != nil {
-						http.Error(w, "bad request", 400)
+						writeAPError(w, errorStatus(err, 422), "failed to resolve actor")
 						log.Error().Err(err).Msg("failed to get nostr keys by actor")
 						return
 					}
@@ -67,82 +243,395 @@ func (h *Handler) InboxHandler() HandlerResponse {
 			}
 
 			switch create.Object.Type {
-			case "Note":
-				var note litepub.Create[litepub.Note]
+			case "Note", "Question":
+				var note litepub.Create[Note]
 				if err := json.Unmarshal(body, &note); err != nil {
-					http.Error(w, "bad request", 400)
+					writeAPError(w, 400, "bad request")
 					log.Error().Err(err).Msg("failed to decode request body to note type")
 					return
 				}
 
-				_, err := h.activitypub.NoteToEvent(&note.Object)
+				// we sign it with the author's key, so only they get to post it
+				if create.Actor != note.Object.AttributedTo {
+					writeAPError(w, 403, "forbidden")
+					log.Warn().Str("actor", create.Actor).Str("note", note.Object.Id).Msg("refusing to create someone else's note")
+					return
+				}
+
+				event, err := h.activitypub.NoteToEvent(ctx, &note.Object)
 				if err != nil {
-					http.Error(w, "bad request", 400)
+					writeAPError(w, errorStatus(err, 422), "failed to convert note")
 					log.Error().Err(err).Msg("failed to convert note to event")
 					return
 				}
 
+				// cache it so that it's served by id right away, and hand it to the relay for its subscribers
+				if err := h.cache.CacheEvent(*event); err != nil {
+					log.Warn().Err(err).Str("id", event.ID).Msg("failed to cache note")
+				}
+				h.broadcastEvent(*event)
+
 				break
-			case "Person":
-				var follow litepub.Follow
-				if err := json.Unmarshal(body, &follow); err != nil {
-					http.Error(w, "bad request", 400)
-					log.Error().Err(err).Msg("failed to decode request body to follow type")
+			case "Image", "Video", "Audio":
+				var media litepub.Create[Media]
+				if err := json.Unmarshal(body, &media); err != nil {
+					writeAPError(w, 400, "bad request")
+					log.Error().Err(err).Msg("failed to decode request body to media type")
 					return
 				}
 
-				objectParts := strings.Split(follow.Object, "/")
-				nostrPubKey := objectParts[len(objectParts)-1]
+				if create.Actor != media.Object.AttributedTo {
+					writeAPError(w, 403, "forbidden")
+					log.Warn().Str("actor", create.Actor).Str("media", media.Object.Id).Msg("refusing to create someone else's media")
+					return
+				}
 
-				if err := h.db.FollowNostrPubKey(follow.Actor, nostrPubKey); err != nil {
-					http.Error(w, "failed to follow user", 500)
-					log.Error().Err(err).Msg("failed to follow user")
+				event, err := h.activitypub.NoteToEvent(ctx, media.Object.asNote())
+				if err != nil {
+					writeAPError(w, errorStatus(err, 422), "failed to convert media")
+					log.Error().Err(err).Msg("failed to convert media to event")
 					return
 				}
+
+				if err := h.cache.CacheEvent(*event); err != nil {
+					log.Warn().Err(err).Str("id", event.ID).Msg("failed to cache media note")
+				}
+				h.broadcastEvent(*event)
+
+				break
+			case "Article":
+				var article litepub.Create[Note]
+				if err := json.Unmarshal(body, &article); err != nil {
+					writeAPError(w, 400, "bad request")
+					log.Error().Err(err).Msg("failed to decode request body to article type")
+					return
+				}
+
+				if create.Actor != article.Object.AttributedTo {
+					writeAPError(w, 403, "forbidden")
+					log.Warn().Str("actor", create.Actor).Str("article", article.Object.Id).Msg("refusing to create someone else's article")
+					return
+				}
+
+				event, err := h.activitypub.ArticleToEvent(ctx, &article.Object)
+				if err != nil {
+					writeAPError(w, errorStatus(err, 422), "failed to convert article")
+					log.Error().Err(err).Msg("failed to convert article to event")
+					return
+				}
+
+				if err := h.cache.CacheEvent(*event); err != nil {
+					log.Warn().Err(err).Str("id", event.ID).Msg("failed to cache article")
+				}
+				h.broadcastEvent(*event)
+
 				break
 			default:
 				log.Warn().Msg(fmt.Sprintf("unsupported object type: %s", create.Object.Type))
 				break
 			}
 
+			break
+		case "Follow":
+			var follow litepub.Follow
+			if err := json.Unmarshal(body, &follow); err != nil {
+				writeAPError(w, 400, "bad request")
+				log.Error().Err(err).Msg("failed to decode request body to follow type")
+				return
+			}
+
+			objectParts := strings.Split(follow.Object, "/")
+			nostrPubKey := objectParts[len(objectParts)-1]
+
+			// let the follower know right away when we won't honor the follow, so it doesn't stay pending forever
+			reason := ""
+			switch {
+			case isRelayFollow(follow.Object, h.settings):
+				// a fediverse relay subscribing to the public notes we bridge, through the instance actor
+				if !h.settings.AcceptRelays {
+					reason = "not accepting relays"
+				} else if recipient != "" {
+					reason = "not the actor of this inbox"
+				} else if err := h.db.SaveRelaySubscriber(ctx, follow.Actor); err != nil {
+					log.Error().Err(err).Msg("failed to save relay subscriber")
+					reason = "failed to save follow"
+				} else {
+					log.Info().Str("relay", follow.Actor).Msg("relay subscribed")
+				}
+			case !strings.HasPrefix(follow.Object, h.settings.ServiceURL+"/pub/user/") || !isPubKeyHex(nostrPubKey):
+				reason = "not one of our actors"
+			case recipient != "" && nostrPubKey != recipient:
+				reason = "not the actor of this inbox"
+			case h.policy.BlocksPubKey(nostrPubKey):
+				reason = "pubkey is blocked"
+			default:
+				if err := h.db.FollowNostrPubKey(ctx, follow.Actor, nostrPubKey); err != nil {
+					log.Error().Err(err).Msg("failed to follow user")
+					reason = "failed to save follow"
+				}
+			}
+
+			if reason != "" {
+				log.Info().Str("actor", follow.Actor).Str("object", follow.Object).Str("reason", reason).Msg("rejecting follow")
+				tasks.Go(func() {
+					if err := h.activitypub.RejectFollow(context.Background(), follow); err != nil {
+						log.Warn().Err(err).Str("actor", follow.Actor).Msg("failed to reject follow")
+					}
+				})
+				break
+			}
+
+			tasks.Go(func() {
+				if err := h.activitypub.AcceptFollow(context.Background(), follow); err != nil {
+					log.Warn().Err(err).Str("actor", follow.Actor).Msg("failed to accept follow")
+				}
+			})
+
+			break
+		case "Update":
+			var update litepub.Create[litepub.Base]
+			if err := json.Unmarshal(body, &update); err != nil {
+				writeAPError(w, 400, "bad request")
+				log.Error().Err(err).Msg("failed to decode request body to update type")
+				return
+			}
+
+			switch update.Object.Type {
+			case "Person":
+				var person litepub.Create[Actor]
+				if err := json.Unmarshal(body, &person); err != nil {
+					writeAPError(w, 400, "bad request")
+					log.Error().Err(err).Msg("failed to decode request body to actor type")
+					return
+				}
+
+				if update.Actor != person.Object.Id {
+					writeAPError(w, 403, "forbidden")
+					log.Warn().Str("actor", update.Actor).Str("object", person.Object.Id).Msg("refusing to update another actor")
+					return
+				}
+
+				_, pubkey, err := h.nostr.GetNostrKeysByActor(ctx, person.Object.Id)
+				if err != nil {
+					writeAPError(w, errorStatus(err, 422), "failed to resolve actor")
+					log.Error().Err(err).Msg("failed to get nostr keys by actor")
+					return
+				}
+
+				if err := h.cache.ClearCacheByKey(metadataKey(pubkey)); err != nil {
+					log.Warn().Err(err).Msg("failed to clear cached metadata")
+				}
+
+				event, err := h.activitypub.ActorToEvent(ctx, &person.Object)
+				if err != nil {
+					writeAPError(w, errorStatus(err, 422), "failed to convert actor")
+					log.Error().Err(err).Msg("failed to convert actor to event")
+					return
+				}
+
+				if err := h.cache.CacheEvent(*event); err != nil {
+					log.Warn().Err(err).Msg("failed to cache updated metadata")
+				}
+
+				break
+			case "Note", "Question":
+				var note litepub.Create[Note]
+				if err := json.Unmarshal(body, &note); err != nil {
+					writeAPError(w, 400, "bad request")
+					log.Error().Err(err).Msg("failed to decode request body to note type")
+					return
+				}
+
+				if update.Actor != note.Object.AttributedTo {
+					writeAPError(w, 403, "forbidden")
+					log.Warn().Str("actor", update.Actor).Str("note", note.Object.Id).Msg("refusing to update someone else's note")
+					return
+				}
+
+				// notes are immutable on nostr, so the edit is a new event that supersedes the one we had
+				oldID, err := h.db.GetEventIDByNoteURL(ctx, note.Object.Id)
+				if err != nil {
+					writeAPError(w, 500, "failed to update note")
+					log.Error().Err(err).Msg("failed to get event id by note url")
+					return
+				}
+
+				event, err := h.activitypub.NoteToEvent(ctx, &note.Object)
+				if err != nil {
+					writeAPError(w, errorStatus(err, 422), "failed to convert note")
+					log.Error().Err(err).Msg("failed to convert note to event")
+					return
+				}
+
+				if oldID != "" && oldID != event.ID {
+					if err := h.db.DeleteNote(ctx, oldID); err != nil {
+						log.Warn().Err(err).Msg("failed to delete superseded note")
+					}
+
+					deletion, err := h.activitypub.DeletionEvent(ctx, update.Actor, oldID)
+					if err != nil {
+						log.Warn().Err(err).Msg("failed to create deletion event")
+					} else {
+						h.broadcastEvent(*deletion)
+					}
+				}
+
+				if err := h.cache.CacheEvent(*event); err != nil {
+					log.Warn().Err(err).Msg("failed to cache updated note")
+				}
+				h.broadcastEvent(*event)
+
+				break
+			case "Article":
+				var article litepub.Create[Note]
+				if err := json.Unmarshal(body, &article); err != nil {
+					writeAPError(w, 400, "bad request")
+					log.Error().Err(err).Msg("failed to decode request body to article type")
+					return
+				}
+
+				if update.Actor != article.Object.AttributedTo {
+					writeAPError(w, 403, "forbidden")
+					log.Warn().Str("actor", update.Actor).Str("article", article.Object.Id).Msg("refusing to update someone else's article")
+					return
+				}
+
+				// the new version replaces the old one on relays, it's addressed by the article's url
+				event, err := h.activitypub.ArticleToEvent(ctx, &article.Object)
+				if err != nil {
+					writeAPError(w, errorStatus(err, 422), "failed to convert article")
+					log.Error().Err(err).Msg("failed to convert article to event")
+					return
+				}
+
+				if err := h.cache.CacheEvent(*event); err != nil {
+					log.Warn().Err(err).Msg("failed to cache updated article")
+				}
+				h.broadcastEvent(*event)
+
+				break
+			default:
+				log.Warn().Msg(fmt.Sprintf("unsupported update object type: %s", update.Object.Type))
+				break
+			}
+
 			break
 		case "Delete":
-			var del litepub.Create[string]
+			var del litepub.Create[json.RawMessage]
 			if err := json.Unmarshal(body, &del); err != nil {
-				http.Error(w, "bad request", 400)
+				writeAPError(w, 400, "bad request")
 				log.Error().Err(err).Msg("failed to decode request body to delete type")
 				return
 			}
 
-			if err := h.db.DeleteNoteByUrl(del.Object); err != nil {
-				http.Error(w, "failed to delete note", 500)
+			objectUrl := objectID(del.Object)
+			pubkey, err := h.db.GetPubKeyByActorUrl(ctx, objectUrl)
+			if err != nil {
+				writeAPError(w, 500, "failed to delete")
+				log.Error().Err(err).Msg("failed to get pubkey by actor url")
+				return
+			}
+
+			if pubkey != "" {
+				// the whole account is gone, which only the account itself can tell us
+				if del.Actor != objectUrl {
+					writeAPError(w, 403, "forbidden")
+					log.Warn().Str("actor", del.Actor).Str("object", objectUrl).Msg("refusing to delete another actor")
+					return
+				}
+
+				if err := h.db.DeleteActor(ctx, objectUrl, pubkey); err != nil {
+					writeAPError(w, 500, "failed to delete actor")
+					log.Error().Err(err).Msg("failed to delete actor")
+					return
+				}
+
+				log.Info().Str("actor", objectUrl).Str("pubkey", pubkey).Msg("deleted actor")
+				break
+			}
+
+			// only the note's author gets to delete it, and we're signing the deletion with their key
+			eventID, author, err := h.db.GetNoteAuthor(ctx, objectUrl)
+			if err != nil {
+				writeAPError(w, 500, "failed to delete note")
+				log.Error().Err(err).Msg("failed to get note author")
+				return
+			}
+			if eventID == "" {
+				break
+			}
+			if author == "" {
+				if event, err := h.nostr.GetEventByID(ctx, eventID); err == nil && event != nil {
+					author = event.PubKey
+				}
+			}
+			authorUrl, err := h.db.GetActorURLByPubKey(ctx, author)
+			if err != nil {
+				writeAPError(w, 500, "failed to delete note")
+				log.Error().Err(err).Msg("failed to get actor url by pubkey")
+				return
+			}
+			if author == "" || authorUrl != del.Actor {
+				writeAPError(w, 403, "forbidden")
+				log.Warn().Str("actor", del.Actor).Str("note", objectUrl).Msg("refusing to delete someone else's note")
+				return
+			}
+
+			eventID, err = h.db.DeleteNoteByUrl(ctx, objectUrl)
+			if err != nil {
+				writeAPError(w, 500, "failed to delete note")
 				log.Error().Err(err).Msg("failed to delete note")
 				return
 			}
 
+			if eventID != "" {
+				deletion, err := h.activitypub.DeletionEvent(ctx, del.Actor, eventID)
+				if err != nil {
+					log.Warn().Err(err).Msg("failed to create deletion event")
+					break
+				}
+
+				h.broadcastEvent(*deletion)
+			}
+
 			break
 		case "Undo":
 			var undo litepub.Create[litepub.Base]
 			if err := json.Unmarshal(body, &undo); err != nil {
-				http.Error(w, "bad request", 400)
+				writeAPError(w, 400, "bad request")
 				log.Error().Err(err).Msg("failed to decode request body to create type")
 				return
 			}
 
 			switch undo.Object.Type {
-			case "Person":
+			case "Follow":
 				var follow litepub.Create[litepub.Follow]
 				if err := json.Unmarshal(body, &follow); err != nil {
-					http.Error(w, "bad request", 400)
+					writeAPError(w, 400, "bad request")
 					log.Error().Err(err).Msg("failed to decode request body to undo follow type")
 					return
 				}
 
+				if isRelayFollow(follow.Object.Object, h.settings) {
+					if err := h.db.DeleteRelaySubscriber(ctx, follow.Actor); err != nil {
+						writeAPError(w, 500, "failed to unsubscribe relay")
+						log.Error().Err(err).Msg("failed to delete relay subscriber")
+						return
+					}
+
+					log.Info().Str("relay", follow.Actor).Msg("relay unsubscribed")
+					break
+				}
+
 				objectParts := strings.Split(follow.Object.Object, "/")
 				nostrPubKey := objectParts[len(objectParts)-1]
+				if recipient != "" && nostrPubKey != recipient {
+					log.Debug().Str("object", follow.Object.Object).Str("recipient", recipient).Msg("undo of a follow of someone else")
+					break
+				}
 
-				if err := h.db.UnfollowNostrPubKey(follow.Object.Actor, nostrPubKey); err != nil {
-					http.Error(w, "failed to unfollow user", 500)
+				if err := h.db.UnfollowNostrPubKey(ctx, follow.Object.Actor, nostrPubKey); err != nil {
+					writeAPError(w, 500, "failed to unfollow user")
 					log.Error().Err(err).Msg("failed to unfollow user")
 					return
 				}
@@ -151,6 +640,95 @@ func (h *Handler) InboxHandler() HandlerResponse {
 			default:
 				break
 			}
+		case "Accept", "Reject":
+			// answers to the follows we sent on behalf of nostr users
+			var answer struct {
+				litepub.Base
+				Actor  string          `json:"actor"`
+				Object json.RawMessage `json:"object"`
+			}
+			if err := json.Unmarshal(body, &answer); err != nil {
+				writeAPError(w, 400, "bad request")
+				log.Error().Err(err).Msg("failed to decode request body to accept/reject type")
+				return
+			}
+
+			state := "accepted"
+			if base.Type == "Reject" {
+				state = "rejected"
+			}
+
+			// only the followed actor can answer, which the update checks by matching it against the follow
+			followId := objectID(answer.Object)
+			found, err := h.db.SetRemoteFollowState(ctx, followId, answer.Actor, state)
+			if err != nil {
+				writeAPError(w, 500, "failed to update follow")
+				log.Error().Err(err).Msg("failed to update remote follow state")
+				return
+			}
+			if !found {
+				log.Debug().Str("follow", followId).Str("actor", answer.Actor).Msg("answer to a follow we don't know of")
+				break
+			}
+
+			log.Info().Str("follow", followId).Str("actor", answer.Actor).Str("state", state).Msg("remote follow answered")
+			break
+		case "EmojiReact":
+			var react EmojiReact
+			if err := json.Unmarshal(body, &react); err != nil {
+				writeAPError(w, 400, "bad request")
+				log.Error().Err(err).Msg("failed to decode request body to emoji react type")
+				return
+			}
+
+			event, err := h.activitypub.ReactionEvent(ctx, &react)
+			if err != nil {
+				writeAPError(w, errorStatus(err, 422), "failed to convert reaction")
+				log.Error().Err(err).Msg("failed to convert emoji reaction to event")
+				return
+			}
+
+			h.broadcastEvent(*event)
+			break
+		case "Move":
+			var move struct {
+				litepub.Base
+				Actor  string          `json:"actor"`
+				Object json.RawMessage `json:"object"`
+				Target json.RawMessage `json:"target"`
+			}
+			if err := json.Unmarshal(body, &move); err != nil {
+				writeAPError(w, 400, "bad request")
+				log.Error().Err(err).Msg("failed to decode request body to move type")
+				return
+			}
+
+			oldActor, newActor := objectID(move.Object), objectID(move.Target)
+			if oldActor != move.Actor || newActor == "" {
+				writeAPError(w, 422, "only actors can move themselves")
+				return
+			}
+
+			// the new account has to claim the old one, otherwise anyone could hijack followers
+			target, err := h.fetcher.FetchActor(newActor)
+			if err != nil {
+				writeAPError(w, errorStatus(err, 502), "failed to fetch move target")
+				log.Warn().Err(err).Str("target", newActor).Msg("failed to fetch move target")
+				return
+			}
+			if !slices.Contains(target.AlsoKnownAs, oldActor) {
+				writeAPError(w, 422, "move target doesn't list the old account in alsoKnownAs")
+				return
+			}
+
+			if err := h.db.SaveActorMove(ctx, oldActor, newActor); err != nil {
+				writeAPError(w, 500, "failed to save move")
+				log.Error().Err(err).Msg("failed to save actor move")
+				return
+			}
+
+			log.Info().Str("from", oldActor).Str("to", newActor).Msg("actor moved")
+			break
 		default:
 			break
 		}
@@ -159,114 +737,366 @@ func (h *Handler) InboxHandler() HandlerResponse {
 	}
 }
 
+// authenticate verifies the HTTP Signature of an inbox request, which must cover its target, date and digest, checks
+// those in turn, and returns the actor whose key signed it. The keys of the actors we know are tried first, the
+// key is fetched again when that fails, as happens once it was rotated.
+func (h *Handler) authenticate(ctx context.Context, r *http.Request, raw []byte, body []byte) (string, error) {
+	params, err := parseSignature(r.Header.Get("Signature"))
+	if err != nil {
+		return "", err
+	}
+	for _, required := range []string{"(request-target)", "date", "digest"} {
+		if !slices.Contains(params.headers, required) {
+			return "", fmt.Errorf("signature doesn't cover %s", required)
+		}
+	}
+
+	// senders of compressed bodies don't agree on whether the digest is of the compressed bytes or not
+	if err := verifyDigest(r.Header.Get("Digest"), raw); err != nil && verifyDigest(r.Header.Get("Digest"), body) != nil {
+		return "", err
+	}
+	if err := checkDate(r.Header.Get("Date"), h.settings.DateSkew); err != nil {
+		return "", err
+	}
+
+	message := signingString(r, params.headers)
+	actorUrl, publicKeyPEM, err := h.db.GetActorKey(ctx, params.keyId)
+	if err != nil {
+		log.Warn().Err(err).Str("key", params.keyId).Msg("failed to get actor key")
+	}
+	if publicKeyPEM != "" && verifySignature(publicKeyPEM, params.algorithm, message, params.signature) == nil {
+		return actorUrl, nil
+	}
+
+	keyUrl, _, _ := strings.Cut(params.keyId, "#")
+	owner, err := h.fetcher.FetchActor(keyUrl)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch key %s: %w", params.keyId, err)
+	}
+	if owner.Id == "" {
+		return "", fmt.Errorf("key %s has no owner", params.keyId)
+	}
+	if owner.Id != keyUrl {
+		// whoever serves the key can claim it's anyone's, only the actor's own document can tell
+		if owner, err = h.fetcher.FetchActor(owner.Id); err != nil {
+			return "", fmt.Errorf("failed to fetch the owner of key %s: %w", params.keyId, err)
+		}
+	}
+	if !sameHost(owner.Id, keyUrl) || owner.PublicKey.Id != params.keyId ||
+		(owner.PublicKey.Owner != "" && owner.PublicKey.Owner != owner.Id) {
+		return "", fmt.Errorf("key %s isn't the one of %s", params.keyId, owner.Id)
+	}
+	if err := verifySignature(owner.PublicKey.PublicKeyPEM, params.algorithm, message, params.signature); err != nil {
+		return "", err
+	}
+
+	if err := h.db.SaveActor(ctx, owner); err != nil {
+		log.Warn().Err(err).Str("actor", owner.Id).Msg("failed to save actor key")
+	}
+	return owner.Id, nil
+}
+
+// statusRecorder remembers the status a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// writeAPError answers with an error body ActivityPub clients can parse, instead of http.Error's plain text.
+func writeAPError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/activity+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// errorStatus maps the errors we know about to the status they should be reported with, and anything else to fallback.
+func errorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, errNotFederated):
+		return 403
+	case errors.Is(err, errEventNotFound), errors.Is(err, sql.ErrNoRows):
+		return 404
+	case errors.Is(err, context.DeadlineExceeded):
+		return 504
+	default:
+		return fallback
+	}
+}
+
+// isRelayFollow tells whether a follow of object is a fediverse relay subscribing to us, which follows either
+// the instance actor, as Mastodon relays do, or the public collection, as LitePub ones do.
+func isRelayFollow(object string, settings Settings) bool {
+	return object == settings.ServiceURL+"/pub/instance" || object == "https://www.w3.org/ns/activitystreams#Public"
+}
+
+// objectID returns the id of an activity's object, which may be either inlined or just referenced by its URL.
+func objectID(object json.RawMessage) string {
+	var id string
+	if err := json.Unmarshal(object, &id); err == nil {
+		return id
+	}
+
+	var base litepub.Base
+	_ = json.Unmarshal(object, &base)
+	return base.Id
+}
+
 // UserByPubKeyHandler returns the user details for a given pubkey.
 func (h *Handler) UserByPubKeyHandler() HandlerResponse {
 	return func(w http.ResponseWriter, r *http.Request) {
-		nostrPubKey := mux.Vars(r)["pubkey"]
-		metadata, err := h.nostr.GetMetadataByPubKey(nostrPubKey)
+		nostrPubKey, err := pubKeyParam(r)
 		if err != nil {
-			http.Error(w, "failed to get metadata", 500)
+			writeAPError(w, 400, err.Error())
 			return
 		}
 
-		actor := h.nostr.EventToActor(*metadata)
-		w.Header().Set("Content-Type", "application/activity+json")
+		if wantsHTML(r) {
+			npub, _ := nip19.EncodePublicKey(nostrPubKey)
+			http.Redirect(w, r, fmt.Sprintf(h.settings.WebURL, npub), http.StatusSeeOther)
+			return
+		}
+
+		metadata, err := h.nostr.GetMetadataByPubKey(r.Context(), nostrPubKey)
+		if err != nil {
+			writeAPError(w, errorStatus(err, 500), "failed to get metadata")
+			return
+		}
+
+		actor := h.nostr.EventToActor(r.Context(), *metadata)
+		if notModified(w, r, append([]string{metadata.ID}, actor.AlsoKnownAs...)...) {
+			return
+		}
+
+		w.Header().Set("Content-Type", activityContentType(r))
 		err = json.NewEncoder(w).Encode(actor)
 
 		if err != nil {
 			log.Error().Err(err).Msg("failed to encode actor")
-			http.Error(w, "failed to encode actor", 500)
+			writeAPError(w, 500, "failed to encode actor")
+			return
+		}
+	}
+}
+
+func (h *Handler) NoteByIDHandler() HandlerResponse {
+	return func(w http.ResponseWriter, r *http.Request) {
+		noteID, err := eventIDParam(r)
+		if err != nil {
+			writeAPError(w, 400, err.Error())
 			return
 		}
+
+		if wantsHTML(r) {
+			code, _ := nip19.EncodeNote(noteID)
+			http.Redirect(w, r, fmt.Sprintf(h.settings.WebURL, code), http.StatusSeeOther)
+			return
+		}
+
+		if deletedAt, err := h.db.GetNoteDeletion(r.Context(), noteID); err == nil {
+			tombstone := Tombstone{
+				Base: litepub.Base{
+					Type: "Tombstone",
+					Id:   fmt.Sprintf("%s/pub/note/%s", h.settings.ServiceURL, noteID),
+				},
+				FormerType: "Note",
+				Deleted:    deletedAt,
+			}
+			w.Header().Set("Content-Type", activityContentType(r))
+			w.WriteHeader(http.StatusGone)
+			_ = json.NewEncoder(w).Encode(tombstone)
+			return
+		}
+
+		event, err := h.nostr.GetEventByID(r.Context(), noteID)
+		if err != nil {
+			writeAPError(w, errorStatus(err, 500), "failed to get note")
+			return
+		}
+		if event == nil {
+			writeAPError(w, 404, "note not found")
+			return
+		}
+
+		if notModified(w, r, event.ID) {
+			return
+		}
+
+		// where we got it from, to tell why a note is or isn't visible
+		if relays := h.nostr.SeenOn(event.ID); len(relays) > 0 {
+			w.Header().Set("X-Nostr-Relays", strings.Join(relays, ", "))
+		}
+
+		note := h.nostr.EventToNote(*event)
+		w.Header().Set("Content-Type", activityContentType(r))
+		_ = json.NewEncoder(w).Encode(note)
+	}
+}
+
+// ArticleByIDHandler serves a NIP-23 long-form event as an Article.
+// HTTP: /pub/article/{id}
+func (h *Handler) ArticleByIDHandler() HandlerResponse {
+	return func(w http.ResponseWriter, r *http.Request) {
+		articleID, err := eventIDParam(r)
+		if err != nil {
+			writeAPError(w, 400, err.Error())
+			return
+		}
+
+		if wantsHTML(r) {
+			code, _ := nip19.EncodeNote(articleID)
+			http.Redirect(w, r, fmt.Sprintf(h.settings.WebURL, code), http.StatusSeeOther)
+			return
+		}
+
+		event, err := h.nostr.GetEventByID(r.Context(), articleID)
+		if err != nil {
+			writeAPError(w, errorStatus(err, 500), "failed to get article")
+			return
+		}
+		if event == nil || event.Kind != 30023 {
+			writeAPError(w, 404, "article not found")
+			return
+		}
+
+		if notModified(w, r, event.ID) {
+			return
+		}
+
+		article := h.nostr.EventToArticle(*event)
+		w.Header().Set("Content-Type", activityContentType(r))
+		_ = json.NewEncoder(w).Encode(article)
 	}
 }
 
-func (h *Handler) NoteByIDHandler() HandlerResponse {
+// NoteSourceHandler points at the fediverse original of a bridged note, redirecting browsers straight to it.
+// HTTP: /pub/note/{id}/source
+func (h *Handler) NoteSourceHandler() HandlerResponse {
 	return func(w http.ResponseWriter, r *http.Request) {
-		noteID := mux.Vars(r)["id"]
-		event, err := h.nostr.GetEventByID(noteID)
+		noteID, err := eventIDParam(r)
 		if err != nil {
-			http.Error(w, "failed to get note", 500)
+			writeAPError(w, 400, err.Error())
 			return
 		}
 
-		note := h.nostr.EventToNote(*event)
-		w.Header().Set("Content-Type", "application/activity+json")
-		_ = json.NewEncoder(w).Encode(note)
+		noteUrl, err := h.db.GetNoteURLByEventID(r.Context(), noteID)
+		if err != nil {
+			writeAPError(w, errorStatus(err, 500), "failed to get note")
+			return
+		}
+		if noteUrl == "" {
+			writeAPError(w, 404, "note not bridged from the fediverse")
+			return
+		}
+
+		if wantsHTML(r) {
+			http.Redirect(w, r, noteUrl, http.StatusFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"url": noteUrl})
 	}
 }
 
 func (h *Handler) FollowersByPubKey() HandlerResponse {
 	return func(w http.ResponseWriter, r *http.Request) {
-		pubkey := mux.Vars(r)["pubkey"]
-		page := r.URL.Query().Get("page")
-		var followers []string
+		pubkey, err := pubKeyParam(r)
+		if err != nil {
+			writeAPError(w, 400, err.Error())
+			return
+		}
+
+		page, ok := pageNumber(r)
+		if !ok {
+			writeAPError(w, 400, "invalid page")
+			return
+		}
 
-		followers, err := h.nostr.GetFollowersByPubKey(pubkey)
+		followers, total, err := h.nostr.GetFollowersByPubKey(r.Context(), pubkey, collectionPageSize, (page-1)*collectionPageSize)
 		if err != nil {
-			http.Error(w, "failed to get followers", 500)
+			writeAPError(w, 500, "failed to get followers")
 			return
 		}
 
-		response := litepub.OrderedCollectionPage[string]{
-			Base: litepub.Base{
-				Type: "OrderedCollectionPage",
-				Id:   fmt.Sprintf("%s/pub/user/%s/followers?page=1", s.ServiceURL, pubkey),
-			},
-			PartOf:       fmt.Sprintf("%s/pub/user/%s/followers", s.ServiceURL, pubkey),
-			TotalItems:   len(followers),
-			OrderedItems: followers,
+		if notModified(w, r, append([]string{r.URL.RawQuery, strconv.Itoa(total)}, followers...)...) {
+			return
 		}
 
-		if page == "" {
+		response := newCollectionPage(fmt.Sprintf("%s/pub/user/%s/followers", s.ServiceURL, pubkey), page, total, followers)
+
+		if r.URL.Query().Get("page") == "" {
 			pageBody, err := json.Marshal(response)
 			if err != nil {
-				http.Error(w, "failed to marshal followers", 500)
+				writeAPError(w, 500, "failed to marshal followers")
 				return
 			}
 
 			pageResponse := litepub.OrderedCollection{
 				Base: litepub.Base{
 					Type: "OrderedCollection",
-					Id:   fmt.Sprintf("%s/pub/user/%s/following", s.ServiceURL, pubkey),
+					Id:   fmt.Sprintf("%s/pub/user/%s/followers", s.ServiceURL, pubkey),
 				},
 				First:      json.RawMessage(pageBody),
-				TotalItems: len(followers),
+				TotalItems: total,
 			}
 
+			w.Header().Set("Content-Type", "application/activity+json")
 			_ = json.NewEncoder(w).Encode(pageResponse)
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/activity+json")
 		_ = json.NewEncoder(w).Encode(response)
 	}
 }
 
 func (h *Handler) FollowingByPubKey() HandlerResponse {
 	return func(w http.ResponseWriter, r *http.Request) {
-		pubkey := mux.Vars(r)["pubkey"]
-		page := r.URL.Query().Get("page")
+		pubkey, err := pubKeyParam(r)
+		if err != nil {
+			writeAPError(w, 400, err.Error())
+			return
+		}
+
+		page, ok := pageNumber(r)
+		if !ok {
+			writeAPError(w, 400, "invalid page")
+			return
+		}
 
-		following, err := h.nostr.GetFollowingByPubKey(pubkey)
+		following, err := h.nostr.GetFollowingByPubKey(r.Context(), pubkey)
 		if err != nil {
-			http.Error(w, "failed to get following", 500)
+			writeAPError(w, 500, "failed to get following")
 			return
 		}
 
-		response := litepub.OrderedCollectionPage[string]{
-			Base: litepub.Base{
-				Type: "OrderedCollectionPage",
-				Id:   fmt.Sprintf("%s/pub/user/%s/following?page=1", s.ServiceURL, pubkey),
-			},
-			PartOf:       fmt.Sprintf("%s/pub/user/%s/following", s.ServiceURL, pubkey),
-			TotalItems:   len(following),
-			OrderedItems: following,
+		// the contact list is a single event, so there's nothing to gain from paginating before this point
+		total := len(following)
+		from := (page - 1) * collectionPageSize
+		if from > total {
+			from = total
+		}
+		to := from + collectionPageSize
+		if to > total {
+			to = total
+		}
+
+		if notModified(w, r, append([]string{r.URL.RawQuery, strconv.Itoa(total)}, following[from:to]...)...) {
+			return
 		}
 
-		if page == "" {
+		response := newCollectionPage(fmt.Sprintf("%s/pub/user/%s/following", s.ServiceURL, pubkey), page, total, following[from:to])
+
+		if r.URL.Query().Get("page") == "" {
 			pageBody, err := json.Marshal(response)
 			if err != nil {
-				http.Error(w, "failed to marshal response", 500)
+				writeAPError(w, 500, "failed to marshal response")
 				return
 			}
 
@@ -276,46 +1106,145 @@ func (h *Handler) FollowingByPubKey() HandlerResponse {
 					Id:   fmt.Sprintf("%s/pub/user/%s/following", s.ServiceURL, pubkey),
 				},
 				First:      json.RawMessage(pageBody),
-				TotalItems: len(following),
+				TotalItems: total,
 			}
 
+			w.Header().Set("Content-Type", "application/activity+json")
 			_ = json.NewEncoder(w).Encode(pageResponse)
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/activity+json")
 		_ = json.NewEncoder(w).Encode(response)
 	}
 }
 
+// collectionPageSize is how many items each page of the followers/following collections holds.
+const collectionPageSize = 50
+
+// pageNumber reads the ?page= querystring value, defaulting to the first page. Pages so far that their offset
+// wouldn't fit in a query are invalid.
+func pageNumber(r *http.Request) (int, bool) {
+	value := r.URL.Query().Get("page")
+	if value == "" {
+		return 1, true
+	}
+
+	page, err := strconv.Atoi(value)
+	if err != nil || page < 1 || page > math.MaxInt32/collectionPageSize {
+		return 0, false
+	}
+
+	return page, true
+}
+
+// newCollectionPage builds the given page of the collection at collectionUrl, linking to its neighbours.
+func newCollectionPage(collectionUrl string, page int, total int, items []string) CollectionPage[string] {
+	response := CollectionPage[string]{
+		Base: litepub.Base{
+			Type: "OrderedCollectionPage",
+			Id:   fmt.Sprintf("%s?page=%d", collectionUrl, page),
+		},
+		PartOf:       collectionUrl,
+		TotalItems:   total,
+		OrderedItems: items,
+	}
+
+	if page*collectionPageSize < total {
+		response.Next = fmt.Sprintf("%s?page=%d", collectionUrl, page+1)
+	}
+	if page > 1 {
+		response.Prev = fmt.Sprintf("%s?page=%d", collectionUrl, page-1)
+	}
+
+	return response
+}
+
 func (h *Handler) OutboxHandler() HandlerResponse {
 	return func(w http.ResponseWriter, r *http.Request) {
-		pubkey := mux.Vars(r)["pubkey"]
-		events, err := h.nostr.GetNotesByPubKey(pubkey)
+		pubkey, err := pubKeyParam(r)
+		if err != nil {
+			writeAPError(w, 400, err.Error())
+			return
+		}
+
+		// ?until= is a unix timestamp, to page back through older notes
+		var until *time.Time
+		if value := r.URL.Query().Get("until"); value != "" {
+			timestamp, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				writeAPError(w, 400, "invalid until")
+				return
+			}
+			t := time.Unix(timestamp, 0)
+			until = &t
+		}
+
+		// ?limit= is how many notes a page holds, bounded by OutboxMaxLimit
+		limit := s.OutboxLimit
+		var limitParam string
+		if value := r.URL.Query().Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				writeAPError(w, 400, "invalid limit")
+				return
+			}
+			if parsed > s.OutboxMaxLimit {
+				parsed = s.OutboxMaxLimit
+			}
+			limit = parsed
+			limitParam = fmt.Sprintf("&limit=%d", limit)
+		}
+
+		events, total, err := h.nostr.GetNotesByPubKey(r.Context(), pubkey, until, limit)
 		if err != nil {
-			http.Error(w, "failed to get notes", 500)
+			writeAPError(w, errorStatus(err, 500), "failed to get notes")
+			return
+		}
+
+		ids := []string{r.URL.RawQuery}
+		for _, event := range events {
+			ids = append(ids, event.ID)
+		}
+		if notModified(w, r, ids...) {
 			return
 		}
 
-		var creates []litepub.Create[litepub.Note]
+		var creates []litepub.Create[Note]
 		for _, event := range events {
 			note := h.nostr.EventToNote(event)
-			wrapped := litepub.WrapCreate(note, fmt.Sprintf("%s/pub/create/%s", s.ServiceURL, event.ID))
+			wrapped := wrapCreate(note, fmt.Sprintf("%s/pub/create/%s", s.ServiceURL, event.ID))
 			creates = append(creates, wrapped)
 		}
 
-		page := litepub.OrderedCollectionPage[litepub.Create[litepub.Note]]{
+		pageId := fmt.Sprintf("%s/pub/user/%s/outbox?page=1%s", s.ServiceURL, pubkey, limitParam)
+		if until != nil {
+			pageId = fmt.Sprintf("%s/pub/user/%s/outbox?page=1&until=%d%s", s.ServiceURL, pubkey, until.Unix(), limitParam)
+		}
+
+		page := CollectionPage[litepub.Create[Note]]{
 			Base: litepub.Base{
 				Type: "OrderedCollectionPage",
-				Id:   fmt.Sprintf("%s/pub/user/%s/outbox", s.ServiceURL, pubkey),
+				Id:   pageId,
 			},
 			PartOf:       fmt.Sprintf("%s/pub/user/%s/outbox", s.ServiceURL, pubkey),
-			TotalItems:   len(creates),
+			TotalItems:   total,
 			OrderedItems: creates,
 		}
+		if len(events) > 0 {
+			// until is inclusive, so the next page starts a second before the last note or it would be repeated
+			page.Next = fmt.Sprintf("%s/pub/user/%s/outbox?page=1&until=%d%s", s.ServiceURL, pubkey, events[len(events)-1].CreatedAt.Unix()-1, limitParam)
+		}
+
+		if r.URL.Query().Get("page") != "" {
+			w.Header().Set("Content-Type", "application/activity+json")
+			_ = json.NewEncoder(w).Encode(page)
+			return
+		}
 
 		first, err := json.Marshal(page)
 		if err != nil {
-			http.Error(w, "failed to marshal page", 500)
+			writeAPError(w, 500, "failed to marshal page")
 			return
 		}
 
@@ -347,18 +1276,31 @@ func (h *Handler) Nip05Handler() HandlerResponse {
 			Relays: make(nip05.Key2RelaysMap),
 		}
 
+		// our own users are named by their pubkey, there's nothing to look up for them
+		if isPubKeyHex(name) {
+			pubkey := strings.ToLower(name)
+			response.Names[name] = pubkey
+			response.Relays[pubkey] = []string{h.settings.RelayURL}
+
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(response)
+			return
+		}
+
 		actorUrl := strings.Replace(name, "_at_", "@", 1)
+		if !h.policy.AllowsDomain(actorUrl[strings.LastIndex(actorUrl, "@")+1:]) {
+			http.Error(w, "unknown name: "+name, 404)
+			return
+		}
+
 		actor, err := litepub.FetchActivityPubURL(actorUrl)
 		if err != nil {
 			log.Debug().Err(err).Str("actor", actorUrl).Msg("failed to fetch pub url")
-			err := json.NewEncoder(w).Encode(response)
-			if err != nil {
-				http.Error(w, "failed to encode response", 500)
-				return
-			}
+			http.Error(w, "unknown name: "+name, 404)
+			return
 		}
 
-		_, pubkey, err := h.nostr.GetNostrKeysByActor(actor)
+		_, pubkey, err := h.nostr.GetNostrKeysByActor(r.Context(), actor)
 		if err != nil {
 			log.Debug().Err(err).Str("actor", actorUrl).Msg("failed to fetch nostr keys")
 			http.Error(w, "failed to encode response", 500)
@@ -368,6 +1310,7 @@ func (h *Handler) Nip05Handler() HandlerResponse {
 		response.Names[name] = pubkey
 		response.Relays[pubkey] = []string{h.settings.RelayURL}
 
+		w.Header().Set("Content-Type", "application/json")
 		err = json.NewEncoder(w).Encode(response)
 		if err != nil {
 			http.Error(w, "failed to encode response", 500)
@@ -376,6 +1319,63 @@ func (h *Handler) Nip05Handler() HandlerResponse {
 	}
 }
 
+// pubKeyParam reads the {pubkey} route variable, given either in hex or as an npub, returning it in lowercase hex
+// after checking that it is an actual public key.
+func pubKeyParam(r *http.Request) (string, error) {
+	pubkey, err := decodeNIP19(mux.Vars(r)["pubkey"], "npub")
+	if err != nil {
+		return "", fmt.Errorf("invalid pubkey: %w", err)
+	}
+
+	raw, _ := hex.DecodeString(pubkey)
+	if _, err := schnorr.ParsePubKey(raw); err != nil {
+		return "", fmt.Errorf("invalid pubkey: %w", err)
+	}
+
+	return pubkey, nil
+}
+
+// eventIDParam reads the {id} route variable, given either in hex or as a note1 code, returning it in lowercase hex.
+func eventIDParam(r *http.Request) (string, error) {
+	id, err := decodeNIP19(mux.Vars(r)["id"], "note")
+	if err != nil {
+		return "", fmt.Errorf("invalid event id: %w", err)
+	}
+
+	return id, nil
+}
+
+// decodeNIP19 turns a NIP-19 code with the given prefix into hex, hex values are passed through as long as
+// they are 32 bytes long.
+func decodeNIP19(value string, prefix string) (string, error) {
+	if strings.HasPrefix(value, prefix+"1") {
+		decodedPrefix, decoded, err := nip19.Decode(value)
+		if err != nil {
+			return "", err
+		}
+		if decodedPrefix != prefix {
+			return "", fmt.Errorf("expected %s, got %s", prefix, decodedPrefix)
+		}
+		value, _ = decoded.(string)
+	}
+
+	if !isPubKeyHex(value) {
+		return "", fmt.Errorf("expected 64 hex characters")
+	}
+
+	return strings.ToLower(value), nil
+}
+
+// isPubKeyHex tells whether name is a hex-encoded nostr public key.
+func isPubKeyHex(name string) bool {
+	if len(name) != 64 {
+		return false
+	}
+
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
 func (h *Handler) WebFingerHandler() HandlerResponse {
 	return func(w http.ResponseWriter, r *http.Request) {
 		name, err := litepub.HandleWebfingerRequest(r)
@@ -386,18 +1386,317 @@ func (h *Handler) WebFingerHandler() HandlerResponse {
 
 		log.Debug().Str("name", name).Msg("got webfinger request")
 
-		response := litepub.WebfingerResponse{
-			Subject: r.URL.Query().Get("resource"),
-			Links: []litepub.WebfingerLink{
-				{
-					Rel:  "self",
-					Type: "application/activity+json",
-					Href: fmt.Sprintf("%s/pub/user/%s", s.ServiceURL, name),
-				},
+		resource := r.URL.Query().Get("resource")
+		domain := strings.ToLower(resource[strings.LastIndex(resource, "@")+1:])
+		if domain != h.settings.Host() {
+			http.Error(w, "unknown account: "+resource, 404)
+			return
+		}
+
+		href := fmt.Sprintf("%s/pub/user/%s", s.ServiceURL, name)
+		if name == instanceActorName {
+			href = fmt.Sprintf("%s/pub/instance", s.ServiceURL)
+		}
+
+		links := []litepub.WebfingerLink{
+			{
+				Rel:  "self",
+				Type: "application/activity+json",
+				Href: href,
 			},
 		}
 
+		// browsers get redirected to WebURL, which is where the profile page is
+		code := name
+		if isPubKeyHex(name) {
+			code, _ = nip19.EncodePublicKey(strings.ToLower(name))
+		}
+		if strings.HasPrefix(code, "npub1") {
+			links = append(links, litepub.WebfingerLink{
+				Rel:  "http://webfinger.net/rel/profile-page",
+				Type: "text/html",
+				Href: fmt.Sprintf(h.settings.WebURL, code),
+			})
+		}
+
+		// ?rel= may be given several times to only get some of the links, but discovery always needs "self"
+		if rels := r.URL.Query()["rel"]; len(rels) > 0 {
+			filtered := links[:0]
+			for _, link := range links {
+				if link.Rel == "self" || slices.Contains(rels, link.Rel) {
+					filtered = append(filtered, link)
+				}
+			}
+			links = filtered
+		}
+
+		response := litepub.WebfingerResponse{
+			Subject: "acct:" + name + "@" + h.settings.Host(),
+			Links:   links,
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(response)
 	}
 }
+
+// RefreshActorHandler drops everything we've cached about a bridged fediverse actor and converts it again
+// right away, for when a profile change hasn't reached us. The actor is given either as the pubkey it is
+// bridged as or as its user@host handle.
+// The bearer token is HMAC-SHA256(SECRET, "admin") in hex.
+// HTTP: /admin/refresh/{actor}
+func (h *Handler) RefreshActorHandler() HandlerResponse {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.isAdmin(r) {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+
+		name := mux.Vars(r)["actor"]
+		var actorUrl string
+		var err error
+		if isPubKeyHex(name) {
+			actorUrl, err = h.db.GetActorURLByPubKey(r.Context(), strings.ToLower(name))
+		} else {
+			domain := name[strings.LastIndex(name, "@")+1:]
+			if !h.policy.AllowsDomain(domain) {
+				http.Error(w, "blocked domain: "+domain, 403)
+				return
+			}
+			actorUrl, err = litepub.FetchActivityPubURL(name)
+		}
+		if err != nil {
+			http.Error(w, "failed to resolve actor: "+err.Error(), 502)
+			return
+		}
+		if actorUrl == "" {
+			http.Error(w, "unknown actor: "+name, 404)
+			return
+		}
+		if !h.policy.AllowsURL(actorUrl) {
+			http.Error(w, "blocked actor: "+actorUrl, 403)
+			return
+		}
+
+		if err := h.cache.ClearCacheByKey(goneKey(actorUrl)); err != nil {
+			log.Warn().Err(err).Str("actor", actorUrl).Msg("failed to clear gone actor")
+		}
+
+		_, pubkey, err := h.nostr.GetNostrKeysByActor(r.Context(), actorUrl)
+		if err != nil {
+			http.Error(w, "failed to get nostr keys", 500)
+			return
+		}
+
+		for _, key := range []string{metadataKey(pubkey), contactListKey(pubkey), actorKey(actorUrl)} {
+			if err := h.cache.ClearCacheByKey(key); err != nil {
+				log.Warn().Err(err).Str("key", key).Msg("failed to clear cache key")
+			}
+		}
+
+		actor, err := h.fetcher.FetchActor(actorUrl)
+		if err != nil {
+			http.Error(w, "failed to fetch actor: "+err.Error(), 502)
+			return
+		}
+
+		metadata, err := h.activitypub.ActorToEvent(r.Context(), actor)
+		if err != nil {
+			http.Error(w, "failed to convert actor", 500)
+			return
+		}
+
+		events := []nostr.Event{*metadata}
+		if follows, err := h.activitypub.ActorFollowsToEvent(r.Context(), actor); err == nil {
+			events = append(events, *follows)
+		}
+		if pins, err := h.activitypub.ActorPinsToEvent(r.Context(), actor); err == nil {
+			h.broadcastEvent(*pins)
+		}
+
+		if err := h.cache.CacheEvents(events); err != nil {
+			log.Warn().Err(err).Msg("failed to cache refreshed actor")
+		}
+		for _, event := range events {
+			h.broadcastEvent(event)
+		}
+
+		log.Info().Str("actor", actorUrl).Str("pubkey", pubkey).Msg("refreshed actor")
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"actor": actorUrl, "pubkey": pubkey})
+	}
+}
+
+// ReloadPolicyHandler makes changes to the blocklist and allowlist take effect right away.
+// HTTP: /admin/policy/reload
+func (h *Handler) ReloadPolicyHandler() HandlerResponse {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.isAdmin(r) {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+
+		if err := h.policy.Reload(r.Context()); err != nil {
+			http.Error(w, "failed to reload policy: "+err.Error(), 500)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AliasesHandler sets the accounts a bridged nostr user declares to also be, which go in its actor's alsoKnownAs
+// so that fediverse accounts can move to or from it. The body is a JSON array of actor URLs, empty to clear them.
+// HTTP: /admin/aliases/{pubkey}
+func (h *Handler) AliasesHandler() HandlerResponse {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.isAdmin(r) {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+
+		pubkey, err := pubKeyParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		var aliases []string
+		if err := json.NewDecoder(r.Body).Decode(&aliases); err != nil {
+			http.Error(w, "expected a JSON array of actor URLs", 400)
+			return
+		}
+		for _, alias := range aliases {
+			if parsed, err := url.Parse(alias); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+				http.Error(w, "invalid alias: "+alias, 400)
+				return
+			}
+		}
+
+		if err := h.db.SaveAliases(r.Context(), pubkey, aliases); err != nil {
+			http.Error(w, "failed to save aliases: "+err.Error(), 500)
+			return
+		}
+
+		log.Info().Str("pubkey", pubkey).Strs("aliases", aliases).Msg("saved aliases")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// PurgeCacheHandler deletes the expired cache entries right away instead of waiting for the next sweep.
+// HTTP: /admin/purge
+func (h *Handler) PurgeCacheHandler() HandlerResponse {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.isAdmin(r) {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+
+		deleted, err := h.cache.Purge(r.Context())
+		if err != nil {
+			http.Error(w, "failed to purge cache: "+err.Error(), 500)
+			return
+		}
+
+		log.Info().Int64("deleted", deleted).Msg("purged cache")
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int64{"deleted": deleted})
+	}
+}
+
+// isAdmin checks the request's bearer token against the one derived from the secret.
+// Without a secret the token would be public knowledge, so admin endpoints are disabled.
+func (h *Handler) isAdmin(r *http.Request) bool {
+	if h.settings.Secret == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	expected := DeriveSecret(h.settings.Secret, "admin")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// MetricsHandler exposes internal counters in the Prometheus text format.
+// HTTP: /metrics
+func (h *Handler) MetricsHandler() HandlerResponse {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		h.cache.WriteMetrics(w)
+		writeFederationMetrics(w)
+	}
+}
+
+// InstanceActorHandler returns the actor representing the bridge itself, which is used to sign
+// requests that aren't made on behalf of any specific user.
+// HTTP: /pub/instance
+func (h *Handler) InstanceActorHandler() HandlerResponse {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor := instanceActor(h.settings)
+
+		w.Header().Set("Content-Type", "application/activity+json")
+		if err := json.NewEncoder(w).Encode(actor); err != nil {
+			log.Error().Err(err).Msg("failed to encode instance actor")
+		}
+	}
+}
+
+// instanceActor is the actor document of the bridge itself.
+func instanceActor(settings Settings) Actor {
+	actorUrl := settings.ServiceURL + "/pub/instance"
+	return Actor{
+		Actor: litepub.Actor{
+			Base: litepub.Base{
+				Id:   actorUrl,
+				Type: "Application",
+			},
+			Name:                      settings.ServiceName,
+			PreferredUsername:         instanceActorName,
+			ManuallyApprovesFollowers: true,
+			URL:                       settings.ServiceURL,
+			Inbox:                     settings.ServiceURL + "/pub",
+			Outbox:                    actorUrl + "/outbox",
+			PublicKey: litepub.PublicKey{
+				Id:           actorUrl + "#main-key",
+				Owner:        actorUrl,
+				PublicKeyPEM: settings.InstancePublicKeyPEM,
+			},
+		},
+		AssertionMethod: multikeys(actorUrl, settings.InstancePublicKeyMultibase),
+	}
+}
+
+// HealthHandler reports whether the service is ready to take traffic, which requires the database to be up.
+// HTTP: /healthz
+func (h *Handler) HealthHandler() HandlerResponse {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := 200
+		database := "ok"
+		if err := h.db.Ping(r.Context()); err != nil {
+			log.Warn().Err(err).Msg("health check failed to ping the database")
+			status = 503
+			database = "unreachable"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"database": database,
+			"relays":   h.nostr.ReachableRelays(),
+		})
+	}
+}
+
+// NotFoundHandler answers paths we have no route for with a JSON error, rather than the HTML of the file server.
+func (h *Handler) NotFoundHandler() HandlerResponse {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeAPError(w, 404, "not found")
+	}
+}
+
+// LiveHandler only tells that the process is up.
+// HTTP: /livez
+func (h *Handler) LiveHandler() HandlerResponse {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// publishRecorder is a NostrProvider standing in for the relays, it only records what's published to it.
+type publishRecorder struct {
+	NostrProvider
+	published chan nostr.Event
+}
+
+func (p *publishRecorder) PublishEvent(ctx context.Context, event nostr.Event) error {
+	p.published <- event
+	return nil
+}
+
+func TestBroadcastEventReachesRelays(t *testing.T) {
+	relay := newMockRelay(t)
+	subscribers := make(chan nostr.Event, 1)
+	h := &Handler{
+		nostr: &NostrService{
+			settings: Settings{RelayQueryTimeout: time.Second},
+			peers:    []string{relay.url},
+			pool:     newRelayPool(),
+		},
+		broadcast: subscribers,
+	}
+
+	note := signedNote(t, "hello from the fediverse")
+	h.broadcastEvent(note)
+
+	select {
+	case got := <-subscribers:
+		if got.ID != note.ID {
+			t.Errorf("subscribers got event %s, want %s", got.ID, note.ID)
+		}
+	default:
+		t.Error("event wasn't handed to the relay's subscribers")
+	}
+
+	select {
+	case got := <-relay.published:
+		if got.ID != note.ID {
+			t.Errorf("relay got event %s, want %s", got.ID, note.ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("event wasn't published to the relay")
+	}
+}
+
+func TestBroadcastEventDropsWhenQueueIsFull(t *testing.T) {
+	relays := &publishRecorder{published: make(chan nostr.Event, 2)}
+	subscribers := make(chan nostr.Event, 1)
+	h := &Handler{nostr: relays, broadcast: subscribers}
+
+	h.broadcastEvent(nostr.Event{ID: "a1"})
+	h.broadcastEvent(nostr.Event{ID: "a2"})
+
+	if len(subscribers) != 1 {
+		t.Errorf("got %d queued events, want 1", len(subscribers))
+	}
+
+	// the relays get it all the same
+	for i := 0; i < 2; i++ {
+		select {
+		case <-relays.published:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of 2 events were published to the relays", i)
+		}
+	}
+}
+
+func TestPubKeyParam(t *testing.T) {
+	pubkey := "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	note, _ := nip19.EncodeNote(pubkey)
+
+	for _, test := range []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"hex", pubkey, pubkey},
+		{"uppercase hex", strings.ToUpper(pubkey), pubkey},
+		{"npub", npub, pubkey},
+		{"too short", pubkey[:63], ""},
+		{"too long", pubkey + "0", ""},
+		{"not hex", strings.Repeat("zz", 32), ""},
+		{"not on the curve", strings.Repeat("ff", 32), ""},
+		{"bad npub checksum", npub[:len(npub)-1] + "q", ""},
+		{"note instead of npub", note, ""},
+		{"empty", "", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := pubKeyParam(withRouteVars(map[string]string{"pubkey": test.value}))
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("got %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestEventIDParam(t *testing.T) {
+	id := "5c83da77af1dec6d7289834998ad7aafbd9e2191396d75ec3cc27f5a77226f36"
+	note, _ := nip19.EncodeNote(id)
+	npub, _ := nip19.EncodePublicKey(id)
+
+	for _, test := range []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"hex", id, id},
+		{"note", note, id},
+		{"odd length", id[:63], ""},
+		{"not hex", strings.Repeat("g", 64), ""},
+		{"npub instead of note", npub, ""},
+		{"bad note checksum", note[:len(note)-1] + "q", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := eventIDParam(withRouteVars(map[string]string{"id": test.value}))
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("got %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+// invalid route values are answered with a 400 before anything is looked up, which the handler's missing
+// providers would make panic otherwise
+func TestHandlersRejectInvalidRouteValues(t *testing.T) {
+	h := &Handler{}
+	for _, test := range []struct {
+		name    string
+		handler HandlerResponse
+		vars    map[string]string
+	}{
+		{"user", h.UserByPubKeyHandler(), map[string]string{"pubkey": "abc"}},
+		{"outbox", h.OutboxHandler(), map[string]string{"pubkey": strings.Repeat("ff", 32)}},
+		{"followers", h.FollowersByPubKey(), map[string]string{"pubkey": "npub1nope"}},
+		{"note", h.NoteByIDHandler(), map[string]string{"id": "abc"}},
+		{"note source", h.NoteSourceHandler(), map[string]string{"id": strings.Repeat("z", 64)}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			test.handler(w, withRouteVars(test.vars))
+			if w.Code != 400 {
+				t.Errorf("got status %d, want 400", w.Code)
+			}
+		})
+	}
+}
+
+func withRouteVars(vars map[string]string) *http.Request {
+	return mux.SetURLVars(httptest.NewRequest("GET", "/", nil), vars)
+}
+
+func TestPageNumber(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		page  int
+		ok    bool
+	}{
+		{"", 1, true},
+		{"?page=1", 1, true},
+		{"?page=7", 7, true},
+		{"?page=0", 0, false},
+		{"?page=-3", 0, false},
+		{"?page=two", 0, false},
+		// its offset would overflow
+		{"?page=9223372036854775807", 0, false},
+		{"?page=99999999", 0, false},
+	} {
+		page, ok := pageNumber(httptest.NewRequest("GET", "/pub/user/x/followers"+test.query, nil))
+		if page != test.page || ok != test.ok {
+			t.Errorf("%q: got %d, %v, want %d, %v", test.query, page, ok, test.page, test.ok)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strings"
+
+	strip "github.com/grokify/html-strip-tags-go"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	spaces        = regexp.MustCompile(`[ \t\r\n]+`)
+	trailingSpace = regexp.MustCompile(` +\n`)
+	blankLines    = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText turns the HTML of a fediverse note into nostr text according to policy: "strip" just drops the
+// tags, "plain" keeps paragraphs, line breaks, quotes and link targets, and "markdown" writes links and
+// emphasis as markdown on top of that. Mentions and hashtags keep their text, which is what people wrote.
+func htmlToText(content string, policy string) string {
+	if policy == "strip" {
+		return strip.StripTags(content)
+	}
+
+	c := &htmlConverter{markdown: policy == "markdown", out: []*strings.Builder{{}}}
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				// not much we can do with broken markup, the tags are better left out
+				return strip.StripTags(content)
+			}
+			break
+		}
+		c.token(tt, z.Token())
+	}
+
+	// whatever wasn't closed still counts
+	for len(c.out) > 1 {
+		c.pop()
+	}
+
+	text := trailingSpace.ReplaceAllString(c.out[0].String(), "\n")
+	return strings.TrimSpace(blankLines.ReplaceAllString(text, "\n\n"))
+}
+
+// htmlConverter writes into the innermost builder, links and quotes get their own until they're closed
+// so that their content can be rewritten as a whole.
+type htmlConverter struct {
+	markdown bool
+	out      []*strings.Builder
+	opened   []html.Token
+	pre      int
+	skip     int
+}
+
+func (c *htmlConverter) token(tt html.TokenType, token html.Token) {
+	switch tt {
+	case html.TextToken:
+		if c.skip > 0 {
+			return
+		}
+		text := token.Data
+		if c.pre == 0 {
+			text = spaces.ReplaceAllString(text, " ")
+		}
+		c.write(text)
+	case html.SelfClosingTagToken, html.StartTagToken:
+		switch token.DataAtom {
+		case atom.Br:
+			c.write("\n")
+		case atom.Hr:
+			c.write("\n\n---\n\n")
+		case atom.Li:
+			c.write("\n- ")
+		case atom.Pre:
+			c.pre++
+			c.write("\n\n")
+		case atom.Script, atom.Style:
+			c.skip++
+		case atom.Strong, atom.B:
+			c.emphasis("**")
+		case atom.Em, atom.I:
+			c.emphasis("_")
+		case atom.Code:
+			if c.markdown && c.pre == 0 {
+				c.write("`")
+			}
+		case atom.A, atom.Blockquote:
+			if tt == html.StartTagToken {
+				c.opened = append(c.opened, token)
+				c.out = append(c.out, &strings.Builder{})
+			}
+		}
+	case html.EndTagToken:
+		switch token.DataAtom {
+		case atom.P, atom.Ul, atom.Ol, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+			c.write("\n\n")
+		case atom.Pre:
+			if c.pre > 0 {
+				c.pre--
+			}
+			c.write("\n\n")
+		case atom.Script, atom.Style:
+			if c.skip > 0 {
+				c.skip--
+			}
+		case atom.Strong, atom.B:
+			c.emphasis("**")
+		case atom.Em, atom.I:
+			c.emphasis("_")
+		case atom.Code:
+			if c.markdown && c.pre == 0 {
+				c.write("`")
+			}
+		case atom.A, atom.Blockquote:
+			if len(c.opened) > 0 && c.opened[len(c.opened)-1].DataAtom == token.DataAtom {
+				c.pop()
+			}
+		}
+	}
+}
+
+func (c *htmlConverter) write(text string) {
+	c.out[len(c.out)-1].WriteString(text)
+}
+
+func (c *htmlConverter) emphasis(marker string) {
+	if c.markdown {
+		c.write(marker)
+	}
+}
+
+// pop closes the innermost link or quote, writing it into the enclosing builder.
+func (c *htmlConverter) pop() {
+	token := c.opened[len(c.opened)-1]
+	inner := c.out[len(c.out)-1].String()
+	c.opened = c.opened[:len(c.opened)-1]
+	c.out = c.out[:len(c.out)-1]
+
+	switch token.DataAtom {
+	case atom.A:
+		c.write(linkText(token, inner, c.markdown))
+	case atom.Blockquote:
+		lines := strings.Split(strings.TrimSpace(blankLines.ReplaceAllString(inner, "\n\n")), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight("> "+line, " ")
+		}
+		c.write("\n\n" + strings.Join(lines, "\n") + "\n\n")
+	}
+}
+
+// linkText is what a link turns into: its target, unless it's a mention or a hashtag or, with markdown,
+// has a text of its own worth keeping.
+func linkText(token html.Token, text string, markdown bool) string {
+	var href, class string
+	for _, attr := range token.Attr {
+		switch attr.Key {
+		case "href":
+			href = attr.Val
+		case "class":
+			class = attr.Val
+		}
+	}
+
+	text = strings.TrimSpace(text)
+	switch {
+	case href == "" || !strings.HasPrefix(href, "http"):
+		return text
+	case strings.Contains(class, "mention") || strings.Contains(class, "hashtag") || strings.HasPrefix(text, "#"):
+		return text
+	case !markdown || text == "" || sameLink(text, href):
+		return href
+	default:
+		return "[" + text + "](" + href + ")"
+	}
+}
+
+// sameLink tells whether the text of a link is just its (possibly shortened) target, as Mastodon displays them.
+func sameLink(text string, href string) bool {
+	bare := strings.TrimPrefix(strings.TrimPrefix(href, "https://"), "http://")
+	text = strings.TrimSuffix(text, "…")
+	return text == href || strings.HasPrefix(bare, strings.TrimPrefix(strings.TrimPrefix(text, "https://"), "http://"))
+}
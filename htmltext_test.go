@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		content  string
+		strip    string
+		plain    string
+		markdown string
+	}{
+		{
+			"paragraphs and line breaks",
+			`<p>Hello <strong>world</strong></p><p>second<br>line</p>`,
+			"Hello worldsecondline",
+			"Hello world\n\nsecond\nline",
+			"Hello **world**\n\nsecond\nline",
+		},
+		{
+			"mentions and hashtags keep their text",
+			`<p>hi <span class="h-card"><a href="https://m.example/@bob" class="u-url mention">@<span>bob</span></a></span> <a href="https://m.example/tags/go" class="mention hashtag" rel="tag">#<span>go</span></a></p>`,
+			"hi @bob #go",
+			"hi @bob #go",
+			"hi @bob #go",
+		},
+		{
+			"links",
+			`<p>see <a href="https://example.com/page">https://example.com/page</a> and <a href="https://example.com/x">this</a></p>`,
+			"see https://example.com/page and this",
+			"see https://example.com/page and https://example.com/x",
+			"see https://example.com/page and [this](https://example.com/x)",
+		},
+		{
+			"shortened links",
+			`<p><a href="https://example.com/a/very/long/path"><span class="invisible">https://</span><span class="ellipsis">example.com/a/very/</span></a></p>`,
+			"https://example.com/a/very/",
+			"https://example.com/a/very/long/path",
+			"https://example.com/a/very/long/path",
+		},
+		{
+			"quotes",
+			`<blockquote><p>quoted</p><p>twice</p></blockquote><p>reply</p>`,
+			"quotedtwicereply",
+			"> quoted\n>\n> twice\n\nreply",
+			"> quoted\n>\n> twice\n\nreply",
+		},
+		{
+			"code",
+			"<p>use <code>go vet</code></p><pre><code>a  b\nc</code></pre>",
+			"use go veta  b\nc",
+			"use go vet\n\na  b\nc",
+			"use `go vet`\n\na  b\nc",
+		},
+		{
+			"lists",
+			`<ul><li>one</li><li>two</li></ul>`,
+			"onetwo",
+			"- one\n- two",
+			"- one\n- two",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for policy, want := range map[string]string{"strip": test.strip, "plain": test.plain, "markdown": test.markdown} {
+				if got := htmlToText(test.content, policy); got != want {
+					t.Errorf("%s: got %q, want %q", policy, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHTMLToTextDropsScriptsAndDecodesEntities(t *testing.T) {
+	content := `<p>a &amp; b</p><script>alert(1)</script><style>p { color: red }</style>`
+	for _, policy := range []string{"plain", "markdown"} {
+		if got := htmlToText(content, policy); got != "a & b" {
+			t.Errorf("%s: got %q, want %q", policy, got, "a & b")
+		}
+	}
+}
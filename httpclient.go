@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// newHTTPClient returns the client all our outbound requests go through, identifying us with settings.UserAgent
+// so that remote admins know who's knocking, and not waiting forever on servers that never answer. With fixtures
+// it never leaves the process.
+func newHTTPClient(settings Settings, fixtures *Fixtures) *http.Client {
+	if fixtures != nil {
+		return &http.Client{
+			Timeout: settings.HTTPTimeout,
+			Transport: userAgentTransport{
+				base:      fixtures,
+				userAgent: settings.UserAgent,
+			},
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   settings.HTTPConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = settings.HTTPConnectTimeout
+	transport.ResponseHeaderTimeout = settings.HTTPTimeout
+	transport.ExpectContinueTimeout = time.Second
+
+	return &http.Client{
+		Timeout: settings.HTTPTimeout,
+		Transport: userAgentTransport{
+			base:      transport,
+			userAgent: settings.UserAgent,
+		},
+	}
+}
+
+// userAgentTransport sets the User-Agent of every request going through it.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t userAgentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(r)
+}
@@ -1,28 +1,263 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rsa"
-	"github.com/fiatjaf/litepub"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
 )
 
+// keyDerivationVersion is the version of deriveNostrKey used for actors we haven't derived a key for yet.
+const keyDerivationVersion = 1
+
+// keyOverrideVersion marks the keys of actors pinned to a fixed keypair in the key_overrides table.
+const keyOverrideVersion = -1
+
 type Keys struct {
-	PrivateKey *rsa.PrivateKey
-	PublicKey  *rsa.PublicKey
+	PrivateKey crypto.Signer
+	PublicKey  crypto.PublicKey
 }
 
-func GenerateKeys(secret string) (*Keys, error) {
+// GenerateKeys deterministically generates a keypair of the given type ("rsa", of the given size, or "ed25519")
+// from the whole of secret.
+func GenerateKeys(secret string, keyType string, bits int) (*Keys, error) {
+	// litepub.GeneratePrivateKey only takes a 4 bytes seed, so we feed the generation from our own stream instead
+	random := &seedReader{seed: sha256.Sum256([]byte(secret))}
+
+	switch keyType {
+	case "rsa":
+		privateKey, err := generateRSAKey(random, bits)
+		if err != nil {
+			return nil, err
+		}
+		return &Keys{privateKey, &privateKey.PublicKey}, nil
+	case "ed25519":
+		seed := make([]byte, ed25519.SeedSize)
+		random.Read(seed)
+		privateKey := ed25519.NewKeyFromSeed(seed)
+		return &Keys{privateKey, privateKey.Public()}, nil
+	default:
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+}
+
+// GenerateLegacyKeys generates the RSA keypairs secrets made before GenerateKeys took the whole of them into
+// account, when litepub.GeneratePrivateKey seeded math/rand with their first 4 bytes. rsa.GenerateKey reads
+// one byte of its input or not at random before it starts, so either keypair may be the one it made. They're
+// only good for finding the keys derived from previous secrets.
+func GenerateLegacyKeys(secret string) ([]*Keys, error) {
 	var seed [4]byte
 	copy(seed[:], secret)
-	privateKey, err := litepub.GeneratePrivateKey(seed)
 
-	keys := Keys{
-		PrivateKey: privateKey,
-		PublicKey:  &privateKey.PublicKey,
+	candidates := make([]*Keys, 0, 2)
+	for _, skipped := range []int{0, 1} {
+		generator := mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint32(seed[:]))))
+		generator.Read(make([]byte, skipped))
+
+		privateKey, err := generateRSAKey(generator, 2048)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, &Keys{privateKey, &privateKey.PublicKey})
 	}
 
-	return &keys, err
+	return candidates, nil
+}
+
+// generateRSAKey generates a two primes RSA key from random the way rsa.GenerateKey used to. That can't be relied
+// on to be deterministic: newer versions of Go ignore random, older ones read a byte of it or not at random.
+func generateRSAKey(random io.Reader, bits int) (*rsa.PrivateKey, error) {
+	one := big.NewInt(1)
+	e := big.NewInt(65537)
+
+	for {
+		p, err := generatePrime(random, bits/2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := generatePrime(random, bits-p.BitLen())
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+
+		n := new(big.Int).Mul(p, q)
+		if n.BitLen() != bits {
+			continue
+		}
+		totient := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		d := new(big.Int)
+		if d.ModInverse(e, totient) == nil {
+			continue
+		}
+
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		key.Precompute()
+		return key, nil
+	}
+}
+
+// generatePrime returns a prime of the given size read from random, the way crypto/rand.Prime does.
+func generatePrime(random io.Reader, bits int) (*big.Int, error) {
+	if bits < 2 {
+		return nil, fmt.Errorf("prime size must be at least 2 bits")
+	}
+
+	b := uint(bits % 8)
+	if b == 0 {
+		b = 8
+	}
+
+	bytes := make([]byte, (bits+7)/8)
+	p := new(big.Int)
+	for {
+		if _, err := io.ReadFull(random, bytes); err != nil {
+			return nil, err
+		}
+
+		// the top two bits set, so that the product of two primes has all its bits, and odd
+		bytes[0] &= uint8(int(1<<b) - 1)
+		if b >= 2 {
+			bytes[0] |= 3 << (b - 2)
+		} else {
+			bytes[0] |= 1
+			if len(bytes) > 1 {
+				bytes[1] |= 0x80
+			}
+		}
+		bytes[len(bytes)-1] |= 1
+
+		p.SetBytes(bytes)
+		if p.ProbablyPrime(20) {
+			return p, nil
+		}
+	}
+}
+
+// seedReader is a deterministic stream of bytes made of SHA-256(seed || counter) blocks.
+type seedReader struct {
+	seed    [32]byte
+	counter uint64
+	buf     []byte
+}
+
+func (r *seedReader) Read(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		if len(r.buf) == 0 {
+			var block [40]byte
+			copy(block[:], r.seed[:])
+			binary.BigEndian.PutUint64(block[32:], r.counter)
+			r.counter++
+
+			sum := sha256.Sum256(block[:])
+			r.buf = sum[:]
+		}
+
+		copied := copy(p[n:], r.buf)
+		r.buf = r.buf[copied:]
+		n += copied
+	}
+
+	return len(p), nil
 }
 
 func (k *Keys) GetPublicKeyPEM() (string, error) {
-	return litepub.PublicKeyToPEM(k.PublicKey)
-}
\ No newline at end of file
+	key, err := x509.MarshalPKIXPublicKey(k.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: key})), nil
+}
+
+// GetPublicKeyMultibase returns the public key in the Multikey format newer fediverse software understands,
+// which we only publish for Ed25519 keys.
+func (k *Keys) GetPublicKeyMultibase() string {
+	key, ok := k.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return ""
+	}
+
+	// multicodec ed25519-pub prefix, then base58btc with its "z" multibase prefix
+	return "z" + base58Encode(append([]byte{0xed, 0x01}, key...))
+}
+
+// DerivationKey is what the keys of bridged actors are derived from.
+func (k *Keys) DerivationKey() []byte {
+	switch key := k.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return key.D.Bytes()
+	case ed25519.PrivateKey:
+		return key.Seed()
+	default:
+		return nil
+	}
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Encode(data []byte) string {
+	n := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+
+	var encoded []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		encoded = append(encoded, base58Alphabet[mod.Int64()])
+	}
+	// leading zero bytes are kept as leading "1"s
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append(encoded, base58Alphabet[0])
+	}
+
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
+
+// deriveNostrKey derives the nostr private key of a fediverse actor from our secret. Keys are stored along
+// with the version that derived them, so changing how they're derived never changes an existing identity:
+//
+//	0: hex(actor || hmac-sha256(secret, "")), which misused the hash API but is kept for the keys derived with it
+//	1: hex(hmac-sha256(secret, 0x01 || actor))
+func deriveNostrKey(secret []byte, actor string, version int) (string, error) {
+	switch version {
+	case 0:
+		return hex.EncodeToString(hmac.New(sha256.New, secret).Sum([]byte(actor))), nil
+	case 1:
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte{byte(version)})
+		mac.Write([]byte(actor))
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	default:
+		return "", fmt.Errorf("unknown key derivation version %d", version)
+	}
+}
+
+// DeriveSecret derives an independent secret for a specific purpose from the main one,
+// so that e.g. the instance actor doesn't share its key with the bridged actors.
+func DeriveSecret(secret string, purpose string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return hex.EncodeToString(mac.Sum(nil))
+}
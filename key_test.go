@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/rsa"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestGenerateKeysIsDeterministic(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ed25519"} {
+		t.Run(keyType, func(t *testing.T) {
+			first := publicKeyPEM(t, GenerateKeys, "correct horse battery staple", keyType)
+			again := publicKeyPEM(t, GenerateKeys, "correct horse battery staple", keyType)
+			if first != again {
+				t.Error("the same secret generated different keys")
+			}
+
+			// secrets used to only count up to their 4th byte
+			other := publicKeyPEM(t, GenerateKeys, "correct horse, but another one", keyType)
+			if first == other {
+				t.Error("different secrets generated the same keys")
+			}
+		})
+	}
+}
+
+func TestGenerateLegacyKeysOnlyUsesTheStartOfTheSecret(t *testing.T) {
+	legacy := func(secret string) []string {
+		candidates, err := GenerateLegacyKeys(secret)
+		if err != nil {
+			t.Fatalf("couldn't generate legacy keys: %v", err)
+		}
+
+		pems := make([]string, len(candidates))
+		for i, keys := range candidates {
+			if pems[i], err = keys.GetPublicKeyPEM(); err != nil {
+				t.Fatalf("couldn't encode legacy public key: %v", err)
+			}
+		}
+		return pems
+	}
+
+	first := legacy("correct horse battery staple")
+	if len(first) != 2 || first[0] == first[1] {
+		t.Fatalf("expected 2 different candidates, got %d", len(first))
+	}
+	if again := legacy("correct horse battery staple"); again[0] != first[0] || again[1] != first[1] {
+		t.Error("the same secret generated different legacy keys")
+	}
+	if same := legacy("corr"); same[0] != first[0] || same[1] != first[1] {
+		t.Error("secrets with the same first 4 bytes generated different legacy keys")
+	}
+	if current := publicKeyPEM(t, GenerateKeys, "correct horse battery staple", "rsa"); current == first[0] || current == first[1] {
+		t.Error("legacy keys are the same as the current ones")
+	}
+}
+
+func TestGeneratedRSAKeysAreValid(t *testing.T) {
+	keys, err := GenerateKeys("correct horse battery staple", "rsa", 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate keys: %v", err)
+	}
+
+	privateKey := keys.PrivateKey.(*rsa.PrivateKey)
+	if err := privateKey.Validate(); err != nil {
+		t.Errorf("generated an invalid key: %v", err)
+	}
+	if privateKey.N.BitLen() != 2048 {
+		t.Errorf("got a %d bits key, want 2048", privateKey.N.BitLen())
+	}
+}
+
+func TestGenerateKeysRejectsUnknownTypes(t *testing.T) {
+	if _, err := GenerateKeys("secret", "dsa", 2048); err == nil {
+		t.Error("expected an error for an unknown key type")
+	}
+}
+
+func publicKeyPEM(t *testing.T, generate func(string, string, int) (*Keys, error), secret string, keyType string) string {
+	t.Helper()
+
+	keys, err := generate(secret, keyType, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate %s keys: %v", keyType, err)
+	}
+	pem, err := keys.GetPublicKeyPEM()
+	if err != nil {
+		t.Fatalf("couldn't encode %s public key: %v", keyType, err)
+	}
+
+	return pem
+}
+
+// the keys of bridged actors must never change, or they'd lose their identity on nostr
+func TestDeriveNostrKeyVectors(t *testing.T) {
+	secret := []byte("no-fed test secret")
+	actor := "https://mastodon.example/users/alice"
+
+	for _, test := range []struct {
+		version int
+		privkey string
+		pubkey  string
+	}{
+		{
+			0,
+			"68747470733a2f2f6d6173746f646f6e2e6578616d706c652f75736572732f616c696365403f3795ef514499ec2834084342ad41c4e248934ca3f4129bf0cedf5c927058",
+			"4410e0d4d8177ba706eacda18d5fe1869217d65bce53904b9ffae3bf5374db14",
+		},
+		{
+			1,
+			"01e0097070e07a53e42f46928246fc7f78cce817f7dfb1c4eb79937bb82783ac",
+			"3aeed437e78ab68d88c5e9d4ae6bac27f29478fba8d54c7e76c936c2399c2989",
+		},
+	} {
+		privkey, err := deriveNostrKey(secret, actor, test.version)
+		if err != nil {
+			t.Fatalf("version %d: %v", test.version, err)
+		}
+		if privkey != test.privkey {
+			t.Errorf("version %d: got private key %s, want %s", test.version, privkey, test.privkey)
+		}
+
+		pubkey, err := nostr.GetPublicKey(privkey)
+		if err != nil {
+			t.Fatalf("version %d: %v", test.version, err)
+		}
+		if pubkey != test.pubkey {
+			t.Errorf("version %d: got public key %s, want %s", test.version, pubkey, test.pubkey)
+		}
+	}
+}
+
+func TestDeriveNostrKeyVersionsDiffer(t *testing.T) {
+	secret := []byte("no-fed test secret")
+
+	v1, _ := deriveNostrKey(secret, "https://mastodon.example/users/alice", 1)
+	if other, _ := deriveNostrKey(secret, "https://mastodon.example/users/bob", 1); v1 == other {
+		t.Error("different actors got the same key")
+	}
+	if other, _ := deriveNostrKey([]byte("another secret"), "https://mastodon.example/users/alice", 1); v1 == other {
+		t.Error("different secrets gave the same key")
+	}
+	if _, err := deriveNostrKey(secret, "https://mastodon.example/users/alice", 2); err == nil {
+		t.Error("expected an error for an unknown version")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/piprate/json-gold/ld"
+)
+
+var (
+	ldLoaderOnce sync.Once
+	ldLoader     ld.DocumentLoader
+)
+
+// ldDocumentLoader fetches the JSON-LD contexts activities refer to, only once each. It is built on first use
+// so that it goes through the default client, which main replaces with ours.
+func ldDocumentLoader() ld.DocumentLoader {
+	ldLoaderOnce.Do(func() {
+		ldLoader = ld.NewCachingDocumentLoader(ld.NewDefaultDocumentLoader(http.DefaultClient))
+	})
+	return ldLoader
+}
+
+// ldSign adds an RsaSignature2017 Linked Data Signature to an activity, the way Mastodon does, so that servers it
+// gets forwarded to can tell it really comes from us. Only RSA keys can make one.
+func ldSign(activity []byte, key crypto.Signer, keyId string) ([]byte, error) {
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("LD signatures need an RSA key")
+	}
+
+	var document map[string]interface{}
+	if err := json.Unmarshal(activity, &document); err != nil {
+		return nil, err
+	}
+	delete(document, "signature")
+
+	options := map[string]interface{}{
+		"@context": "https://w3id.org/identity/v1",
+		"creator":  keyId,
+		"created":  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	optionsHash, err := ldHash(options)
+	if err != nil {
+		return nil, err
+	}
+	documentHash, err := ldHash(document)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(optionsHash + documentHash))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	document["signature"] = map[string]interface{}{
+		"type":           "RsaSignature2017",
+		"creator":        options["creator"],
+		"created":        options["created"],
+		"signatureValue": base64.StdEncoding.EncodeToString(signature),
+	}
+
+	return json.Marshal(document)
+}
+
+// ldHash is the hex SHA-256 of the URDNA2015 canonical form of a JSON-LD document.
+func ldHash(document map[string]interface{}) (string, error) {
+	options := ld.NewJsonLdOptions("")
+	options.Format = "application/n-quads"
+	options.Algorithm = ld.AlgorithmURDNA2015
+	options.DocumentLoader = ldDocumentLoader()
+
+	normalized, err := ld.NewJsonLdProcessor().Normalize(document, options)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256([]byte(normalized.(string)))
+	return hex.EncodeToString(hash[:]), nil
+}
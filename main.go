@@ -1,15 +1,26 @@
 package main
 
 import (
-	"crypto/rsa"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/fiatjaf/relayer"
 	"github.com/jmoiron/sqlx"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/cors"
 	"github.com/rs/zerolog"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -18,12 +29,117 @@ type Settings struct {
 	ServiceURL  string `envconfig:"SERVICE_URL" required:"true"`
 	RelayURL    string
 	Port        string `envconfig:"PORT" required:"true"`
+	ListenHost  string `envconfig:"HOST" default:"0.0.0.0"`
 	PostgresURL string `envconfig:"DATABASE_URL" required:"true"`
 	IconSVG     string `envconfig:"ICON"`
+
+	// StaticDir is served for whatever GET no other route matches, unless ServeStatic is off because something in
+	// front of the bridge serves the website
+	StaticDir   string `envconfig:"STATIC_DIR" default:"./static"`
+	ServeStatic bool   `envconfig:"SERVE_STATIC" default:"true"`
 	Secret      string `envconfig:"SECRET"`
+	LogLevel    string `envconfig:"LOG_LEVEL" default:"info"`
+
+	// PreviousSecrets are secrets used before the current one, so that actors whose keys were derived from
+	// them keep their identity after a rotation
+	PreviousSecrets []string `envconfig:"PREVIOUS_SECRETS"`
+
+	PostgresMaxOpenConns int `envconfig:"DATABASE_MAX_OPEN_CONNS" default:"10"`
+	PostgresMaxIdleConns int `envconfig:"DATABASE_MAX_IDLE_CONNS" default:"5"`
+
+	DeliveryMaxAttempts int `envconfig:"DELIVERY_MAX_ATTEMPTS" default:"8"`
+
+	// CachePurgeInterval is how often expired cache entries are deleted, which POST /admin/purge does on demand
+	CachePurgeInterval time.Duration `envconfig:"CACHE_PURGE_INTERVAL" default:"2h"`
+
+	// LDSignatures adds Linked Data Signatures to the notes we send, which some servers want to accept them once
+	// forwarded. They need KEY_TYPE=rsa.
+	LDSignatures bool `envconfig:"LD_SIGNATURES" default:"false"`
+
+	// GoneTTL is how long actors and notes that are gone or unreachable are not fetched again
+	GoneTTL time.Duration `envconfig:"GONE_TTL" default:"5m"`
+
+	// Mode is "production" or "test", in which the relays and remote servers are replaced by the fixtures in
+	// FixturesPath, for local development and CI
+	Mode         string `envconfig:"MODE" default:"production"`
+	FixturesPath string `envconfig:"FIXTURES" default:"fixtures.json"`
+
+	// UserAgent is sent with every outbound request, "no-fed/1.0 (+{SERVICE_URL})" if not set. HTTPTimeout bounds
+	// them from start to finish, HTTPConnectTimeout just the time taken to connect, TLS handshake included.
+	UserAgent          string        `envconfig:"USER_AGENT"`
+	HTTPTimeout        time.Duration `envconfig:"HTTP_TIMEOUT" default:"10s"`
+	HTTPConnectTimeout time.Duration `envconfig:"HTTP_CONNECT_TIMEOUT" default:"5s"`
+
+	// AcceptRelays lets fediverse relays subscribe to the instance actor, public notes we deliver then also going to them
+	AcceptRelays bool `envconfig:"ACCEPT_RELAYS" default:"false"`
+
+	// InboxMaxBytes is the largest activity we accept, compressed or not, activities being a few KB at most
+	InboxMaxBytes int64 `envconfig:"INBOX_MAX_BYTES" default:"1048576"`
+
+	// DateSkew is how far the Date of an inbox request may be from our clock before it's taken for a replay
+	DateSkew time.Duration `envconfig:"DATE_SKEW" default:"5m"`
+
+	// FederationMode is either "open", federating with anyone not blocked, or "allowlist", federating only
+	// with the domains in the allowlist table
+	FederationMode string `envconfig:"FEDERATION_MODE" default:"open"`
+
+	QueryTimeout      time.Duration `envconfig:"QUERY_TIMEOUT" default:"5s"`
+	RelayQueryTimeout time.Duration `envconfig:"RELAY_QUERY_TIMEOUT" default:"2s"`
+	QueryMinRelays    int           `envconfig:"QUERY_MIN_RELAYS" default:"2"`
+	QueryRelayCount   int           `envconfig:"QUERY_RELAY_COUNT" default:"8"`
+
+	// QueryConcurrency is how many relay queries may run at once, QueryMaxEvents how many events one of them may ask for
+	QueryConcurrency int `envconfig:"QUERY_CONCURRENCY" default:"16"`
+	QueryMaxEvents   int `envconfig:"QUERY_MAX_EVENTS" default:"100"`
+
+	// OutboxLimit is how many notes an outbox page holds unless ?limit= asks for another amount, up to OutboxMaxLimit
+	OutboxLimit    int `envconfig:"OUTBOX_LIMIT" default:"50"`
+	OutboxMaxLimit int `envconfig:"OUTBOX_MAX_LIMIT" default:"200"`
+
+	// OutboxFetchPages is how many pages of a fediverse outbox are walked when backfilling its notes, which stops
+	// earlier once OutboxFetchItems activities were read
+	OutboxFetchPages int `envconfig:"OUTBOX_FETCH_PAGES" default:"5"`
+	OutboxFetchItems int `envconfig:"OUTBOX_FETCH_ITEMS" default:"200"`
+
+	// WebURL is where browsers asking for an actor or a note get redirected to, "%s" is replaced by its NIP-19 code
+	WebURL string `envconfig:"WEB_URL" default:"https://njump.me/%s"`
+
+	// DefaultLanguage is the language picked from multilingual fediverse notes when there's a choice
+	DefaultLanguage string `envconfig:"DEFAULT_LANGUAGE" default:"en"`
+
+	// AltTagPolicy controls when the NIP-31 "alt" tag replaces an event's content: "fallback", "always" or "never"
+	AltTagPolicy string `envconfig:"ALT_TAG_POLICY" default:"fallback"`
+
+	// HTMLPolicy is how the HTML of fediverse notes becomes nostr text: "plain", "markdown" or "strip", which just
+	// drops the tags as we used to. Articles are always converted to markdown, which is what NIP-23 expects.
+	HTMLPolicy string `envconfig:"HTML_POLICY" default:"plain"`
 
-	PrivateKey   *rsa.PrivateKey
-	PublicKeyPEM string
+	// KeyType is the type of the keys our actors sign with, "rsa" (of KeyBits bits) or "ed25519", which not all
+	// fediverse software supports yet. Changing it changes the keys of bridged actors we haven't seen yet.
+	KeyType string `envconfig:"KEY_TYPE" default:"rsa"`
+	KeyBits int    `envconfig:"KEY_BITS" default:"2048"`
+
+	PrivateKey         crypto.Signer
+	PublicKeyPEM       string
+	PublicKeyMultibase string
+	DerivationKey      []byte
+
+	InstancePrivateKey         crypto.Signer
+	InstancePublicKeyPEM       string
+	InstancePublicKeyMultibase string
+
+	// PreviousDerivationKeys are what bridged keys were derived from with each of the PreviousSecrets
+	PreviousDerivationKeys [][]byte
+}
+
+// Host returns the host (including the port, if any) the service is reachable at.
+func (s Settings) Host() string {
+	parsed, err := url.Parse(s.ServiceURL)
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(parsed.Host)
 }
 
 var (
@@ -33,6 +149,12 @@ var (
 )
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	dump := flag.String("dump-actor", "", "print the actor document and public key served for a pubkey, npub or \"instance\", then exit")
+	flag.Parse()
+
 	err := envconfig.Process("", &s)
 	if err != nil {
 		log.Fatal().Err(err).Msg("couldn't process envconfig.")
@@ -40,62 +162,414 @@ func main() {
 	}
 
 	s.RelayURL = strings.Replace(s.ServiceURL, "http", "ws", 1)
+	if s.UserAgent == "" {
+		s.UserAgent = fmt.Sprintf("no-fed/1.0 (+%s)", s.ServiceURL)
+	}
+
+	if s.QueryMinRelays < 1 || s.QueryRelayCount < s.QueryMinRelays {
+		log.Fatal().Int("min", s.QueryMinRelays).Int("count", s.QueryRelayCount).Msg("invalid QUERY_MIN_RELAYS/QUERY_RELAY_COUNT.")
+		return
+	}
+
+	if s.QueryConcurrency < 1 || s.QueryMaxEvents < 1 {
+		log.Fatal().Int("concurrency", s.QueryConcurrency).Int("max", s.QueryMaxEvents).Msg("invalid QUERY_CONCURRENCY/QUERY_MAX_EVENTS.")
+		return
+	}
+
+	if s.OutboxLimit < 1 || s.OutboxMaxLimit < s.OutboxLimit {
+		log.Fatal().Int("limit", s.OutboxLimit).Int("max", s.OutboxMaxLimit).Msg("invalid OUTBOX_LIMIT/OUTBOX_MAX_LIMIT.")
+		return
+	}
 
-	// key stuff (needed for the activitypub integration)
-	keys, err := GenerateKeys(s.Secret)
+	if s.CachePurgeInterval <= 0 {
+		log.Fatal().Msg("CACHE_PURGE_INTERVAL must be positive.")
+		return
+	}
+
+	if s.HTTPTimeout <= 0 || s.HTTPConnectTimeout <= 0 {
+		log.Fatal().Msg("HTTP_TIMEOUT and HTTP_CONNECT_TIMEOUT must be positive.")
+		return
+	}
+
+	if s.OutboxFetchPages <= 0 || s.OutboxFetchItems <= 0 {
+		log.Fatal().Msg("OUTBOX_FETCH_PAGES and OUTBOX_FETCH_ITEMS must be positive.")
+		return
+	}
+
+	if s.InboxMaxBytes <= 0 {
+		log.Fatal().Msg("INBOX_MAX_BYTES must be positive.")
+		return
+	}
+
+	if s.DateSkew <= 0 {
+		log.Fatal().Msg("DATE_SKEW must be positive.")
+		return
+	}
+
+	if s.QueryTimeout <= 0 || s.RelayQueryTimeout <= 0 {
+		log.Fatal().Msg("QUERY_TIMEOUT and RELAY_QUERY_TIMEOUT must be positive.")
+		return
+	}
+
+	switch s.Mode {
+	case "production", "test":
+	default:
+		log.Fatal().Str("mode", s.Mode).Msg("invalid MODE.")
+		return
+	}
+
+	switch s.FederationMode {
+	case "open", "allowlist":
+	default:
+		log.Fatal().Str("mode", s.FederationMode).Msg("invalid FEDERATION_MODE.")
+		return
+	}
+
+	if s.LDSignatures && s.KeyType != "rsa" {
+		log.Fatal().Str("type", s.KeyType).Msg("LD_SIGNATURES needs KEY_TYPE=rsa.")
+		return
+	}
+
+	switch {
+	case s.KeyType == "ed25519":
+	case s.KeyType == "rsa" && s.KeyBits >= 2048 && s.KeyBits <= 8192:
+	default:
+		log.Fatal().Str("type", s.KeyType).Int("bits", s.KeyBits).Msg("invalid KEY_TYPE/KEY_BITS.")
+		return
+	}
+
+	switch s.AltTagPolicy {
+	case "fallback", "always", "never":
+	default:
+		log.Fatal().Str("policy", s.AltTagPolicy).Msg("invalid ALT_TAG_POLICY.")
+		return
+	}
+
+	switch s.HTMLPolicy {
+	case "plain", "markdown", "strip":
+	default:
+		log.Fatal().Str("policy", s.HTMLPolicy).Msg("invalid HTML_POLICY.")
+		return
+	}
+
+	shutdownTracing, err := setupTracing(ctx, s.ServiceName)
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't set up tracing.")
+		return
+	}
+
+	// logger
+	level, err := zerolog.ParseLevel(s.LogLevel)
+	if err != nil {
+		log.Fatal().Err(err).Str("level", s.LogLevel).Msg("invalid LOG_LEVEL.")
+		return
+	}
+	zerolog.SetGlobalLevel(level)
+	log = log.With().Timestamp().Logger()
+
+	// postgres connection, which may not be up yet if we're starting alongside it
+	if err := retry(ctx, 6, time.Second, func() (err error) {
+		pg, err = sqlx.Connect("postgres", s.PostgresURL)
+		return err
+	}); err != nil {
+		log.Fatal().Err(err).Msg("couldn't connect to postgres")
+		return
+	}
+	pg.SetMaxOpenConns(s.PostgresMaxOpenConns)
+	pg.SetMaxIdleConns(s.PostgresMaxIdleConns)
+
+	postgres := NewDatabase(pg)
+
+	if err := postgres.Setup(ctx); err != nil {
+		log.Fatal().Err(err).Msg("couldn't connect to postgres")
+		return
+	}
+
+	// key stuff (needed for the activitypub integration), all of it derived from the secret
+	if s.Secret == "" {
+		s.Secret, err = storedSecret(ctx, postgres)
+		if err != nil {
+			log.Fatal().Err(err).Msg("couldn't get a stored secret.")
+			return
+		}
+	}
+
+	keys, err := GenerateKeys(s.Secret, s.KeyType, s.KeyBits)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error generating keys.")
 		return
 	}
 
 	s.PrivateKey = keys.PrivateKey
+	s.PublicKeyMultibase = keys.GetPublicKeyMultibase()
+	s.DerivationKey = keys.DerivationKey()
 	s.PublicKeyPEM, err = keys.GetPublicKeyPEM()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error getting public key.")
 		return
 	}
 
-	// logger
-	zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	log = log.With().Timestamp().Logger()
+	for _, previous := range s.PreviousSecrets {
+		previousKeys, err := GenerateKeys(previous, s.KeyType, s.KeyBits)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error generating keys from a previous secret.")
+			return
+		}
 
-	// postgres connection
-	postgres := NewDatabase(s.PostgresURL)
-	if err := postgres.Setup(); err != nil {
-		log.Fatal().Err(err).Msg("couldn't connect to postgres")
-		return
+		// the secret may be older than how keys are generated now, bridged keys derived back then come from
+		// what it generated at the time
+		legacyKeys, err := GenerateLegacyKeys(previous)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error generating legacy keys from a previous secret.")
+			return
+		}
+		s.PreviousDerivationKeys = append(s.PreviousDerivationKeys, previousKeys.DerivationKey())
+		for _, keys := range legacyKeys {
+			s.PreviousDerivationKeys = append(s.PreviousDerivationKeys, keys.DerivationKey())
+		}
 	}
 
-	cacheService := NewPostgresCache(s.PostgresURL)
-	go cacheService.SetPurgeFrequency(2 * time.Hour)
+	// the instance actor signs requests on behalf of the bridge itself
+	instanceKeys, err := GenerateKeys(DeriveSecret(s.Secret, "instance"), s.KeyType, s.KeyBits)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error generating instance keys.")
+		return
+	}
 
-	nostrService := NewNostrService(postgres, cacheService, s)
-	activityPubService := NewActivityPub(postgres, nostrService, s)
+	s.InstancePrivateKey = instanceKeys.PrivateKey
+	s.InstancePublicKeyMultibase = instanceKeys.GetPublicKeyMultibase()
+	s.InstancePublicKeyPEM, err = instanceKeys.GetPublicKeyPEM()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error getting instance public key.")
+		return
+	}
 
-	nostrStorage := NewStorage(postgres, activityPubService)
-	relay := NewRelay(nostrStorage)
+	cacheService := NewPostgresCache(pg)
+	go cacheService.SetPurgeFrequency(ctx, s.CachePurgeInterval)
 
-	// define routes
-	relayer.Router.Path("/icon.svg").Methods("GET").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "image/svg+xml")
-			fmt.Fprint(w, s.IconSVG)
+	policy := NewFederationPolicy(postgres, s)
+	if err := policy.Reload(ctx); err != nil {
+		log.Fatal().Err(err).Msg("couldn't load federation policy")
+		return
+	}
+	var fixtures *Fixtures
+	if s.Mode == "test" {
+		fixtures, err = loadFixtures(s.FixturesPath)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", s.FixturesPath).Msg("couldn't load fixtures")
 			return
+		}
+		log.Warn().Str("path", s.FixturesPath).Msg("running in test mode, relays and remote servers are replaced by fixtures")
+	}
+
+	// litepub makes its requests with the default client, so it gets ours too
+	client := newHTTPClient(s, fixtures)
+	http.DefaultClient = client
+
+	fetcher := NewFetcher(client, cacheService, policy, s)
+	nostrService := NewNostrService(postgres, cacheService, fetcher, fixtures, s)
+
+	if *dump != "" {
+		if err := dumpActor(ctx, os.Stdout, nostrService, *dump); err != nil {
+			log.Fatal().Err(err).Str("actor", *dump).Msg("couldn't dump actor")
+		}
+		return
+	}
+
+	tasks.Go(func() { policy.Run(ctx, time.Minute) })
+	tasks.Go(func() { purgeProcessedActivities(ctx, postgres, time.Hour) })
+
+	deliveryWorker := NewDeliveryWorker(client, postgres, policy, s)
+	tasks.Go(func() { deliveryWorker.Run(ctx) })
+
+	activityPubService := NewActivityPub(postgres, nostrService, fetcher, s)
+	if fixtures == nil {
+		tasks.Go(func() {
+			// following from nostr follows on the fediverse too, which takes fetching actors so it isn't done inline
+			nostrService.SubscribeForDelivery(ctx, func(ctx context.Context, contactList nostr.Event) {
+				tasks.Go(func() {
+					if err := activityPubService.SyncFollows(ctx, contactList); err != nil {
+						log.Warn().Err(err).Str("pubkey", contactList.PubKey).Msg("failed to sync follows")
+					}
+				})
+			})
 		})
+	}
 
-	handlers := InitializeHTTPHandlers(postgres, nostrService, activityPubService, s)
+	nostrStorage := NewStorage(postgres, activityPubService, nostrService, fetcher)
+	broadcast := make(chan nostr.Event, 100)
+	relay := NewRelay(nostrStorage, broadcast, policy, ctx.Done())
+
+	// define routes, without ICON it's up to the static directory to have an icon.svg
+	if s.IconSVG != "" {
+		relayer.Router.Path("/icon.svg").Methods("GET").HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/svg+xml")
+				fmt.Fprint(w, s.IconSVG)
+				return
+			})
+	}
+
+	handlers := InitializeHTTPHandlers(postgres, cacheService, nostrService, activityPubService, fetcher, policy, broadcast, s)
 
 	relayer.Router.HandleFunc("/pub", handlers.InboxHandler()).Methods("POST")
-	relayer.Router.HandleFunc("/pub/user/{pubkey:[A-Fa-f0-9]{64}}", handlers.UserByPubKeyHandler()).Methods("GET")
-	relayer.Router.HandleFunc("/pub/user/{pubkey:[A-Fa-f0-9]{64}}/following", handlers.FollowingByPubKey()).Methods("GET")
-	relayer.Router.HandleFunc("/pub/user/{pubkey:[A-Fa-f0-9]{64}}/followers", handlers.FollowersByPubKey()).Methods("GET")
-	relayer.Router.HandleFunc("/pub/user/{pubkey:[A-Fa-f0-9]{64}}/outbox", handlers.OutboxHandler()).Methods("GET")
-	relayer.Router.HandleFunc("/pub/note/{id:[A-Fa-f0-9]{64}}", handlers.NoteByIDHandler()).Methods("GET")
+	relayer.Router.HandleFunc("/pub/instance", handlers.InstanceActorHandler()).Methods("GET")
+	relayer.Router.HandleFunc("/pub/user/{pubkey:[A-Za-z0-9]+}", gzipped(handlers.UserByPubKeyHandler())).Methods("GET")
+	relayer.Router.HandleFunc("/pub/user/{pubkey:[A-Za-z0-9]+}/inbox", handlers.InboxHandler()).Methods("POST")
+	relayer.Router.HandleFunc("/pub/user/{pubkey:[A-Za-z0-9]+}/following", gzipped(handlers.FollowingByPubKey())).Methods("GET")
+	relayer.Router.HandleFunc("/pub/user/{pubkey:[A-Za-z0-9]+}/followers", gzipped(handlers.FollowersByPubKey())).Methods("GET")
+	relayer.Router.HandleFunc("/pub/user/{pubkey:[A-Za-z0-9]+}/outbox", gzipped(handlers.OutboxHandler())).Methods("GET")
+	relayer.Router.HandleFunc("/pub/note/{id:[A-Za-z0-9]+}", gzipped(handlers.NoteByIDHandler())).Methods("GET")
+	relayer.Router.HandleFunc("/pub/note/{id:[A-Za-z0-9]+}/source", handlers.NoteSourceHandler()).Methods("GET")
+	relayer.Router.HandleFunc("/pub/article/{id:[A-Za-z0-9]+}", gzipped(handlers.ArticleByIDHandler())).Methods("GET")
 	relayer.Router.HandleFunc("/.well-known/webfinger", handlers.WebFingerHandler()).Methods("GET")
 	relayer.Router.HandleFunc("/.well-known/nostr.json", handlers.Nip05Handler()).Methods("GET")
+	relayer.Router.HandleFunc("/metrics", handlers.MetricsHandler()).Methods("GET")
+	relayer.Router.HandleFunc("/healthz", handlers.HealthHandler()).Methods("GET")
+	relayer.Router.HandleFunc("/livez", handlers.LiveHandler()).Methods("GET")
+	relayer.Router.HandleFunc("/admin/refresh/{actor}", handlers.RefreshActorHandler()).Methods("POST")
+	relayer.Router.HandleFunc("/admin/policy/reload", handlers.ReloadPolicyHandler()).Methods("POST")
+	relayer.Router.HandleFunc("/admin/purge", handlers.PurgeCacheHandler()).Methods("POST")
+	relayer.Router.HandleFunc("/admin/aliases/{pubkey:[A-Za-z0-9]+}", handlers.AliasesHandler()).Methods("PUT")
+
+	// mistyped ActivityPub paths get a JSON 404 rather than falling through to the static files, and so does
+	// a GET of the shared inbox itself
+	relayer.Router.Path("/pub").HandlerFunc(handlers.NotFoundHandler())
+	for _, prefix := range []string{"/pub/", "/admin/", "/.well-known/"} {
+		relayer.Router.PathPrefix(prefix).HandlerFunc(handlers.NotFoundHandler())
+	}
+	relayer.Router.NotFoundHandler = http.HandlerFunc(handlers.NotFoundHandler())
+
+	if s.ServeStatic {
+		relayer.Router.PathPrefix("/").Methods("GET").Handler(http.FileServer(http.Dir(s.StaticDir)))
+	}
+
+	// relayer.Start only gets to set up relayer.Router (see Relay.OnInitialized), which we serve ourselves
+	go relayer.Start(relay)
+	<-relay.initialized
+
+	server := &http.Server{
+		Handler:           cors.Default().Handler(relayer.Router),
+		Addr:              s.ListenHost + ":" + s.Port,
+		WriteTimeout:      2 * time.Second,
+		ReadTimeout:       2 * time.Second,
+		IdleTimeout:       30 * time.Second,
+		ReadHeaderTimeout: 2 * time.Second,
+	}
+	go func() {
+		log.Info().Str("addr", server.Addr).Msg("listening")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("couldn't listen.")
+		}
+	}()
+
+	<-ctx.Done()
+	log.Info().Msg("shutting down, waiting for pending tasks")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Warn().Err(err).Msg("couldn't shut down the http server")
+	}
+	cancel()
+
+	if !tasks.Wait(10 * time.Second) {
+		log.Warn().Msg("timed out waiting for pending tasks")
+	}
+
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Warn().Err(err).Msg("couldn't flush traces")
+	}
+
+	if err := pg.Close(); err != nil {
+		log.Warn().Err(err).Msg("couldn't close postgres connection")
+	}
+}
+
+// storedSecret returns the secret generated on first boot when SECRET wasn't set, generating it if needed, so that
+// we never run with a predictable secret and our identity survives restarts.
+func storedSecret(ctx context.Context, db StorageProvider) (string, error) {
+	secret, err := db.GetInstanceSetting(ctx, "secret")
+	if err != nil || secret != "" {
+		return secret, err
+	}
+
+	log.Warn().Msg("SECRET is not set and no secret was stored, generating a random one. " +
+		"Back up the instance_settings table: losing it changes the identity of every bridged actor.")
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	// another instance starting at the same time may have beaten us to it, whichever was stored first wins
+	return db.SaveInstanceSetting(ctx, "secret", hex.EncodeToString(random))
+}
+
+// processedActivityTTL is how long we remember the inbox activities we handled, long after anyone retries them.
+const processedActivityTTL = 7 * 24 * time.Hour
+
+// purgeProcessedActivities forgets the activities handled more than processedActivityTTL ago every so often,
+// until ctx is cancelled.
+func purgeProcessedActivities(ctx context.Context, db StorageProvider, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := db.PurgeProcessedActivities(ctx, time.Now().Add(-processedActivityTTL)); err != nil {
+				log.Warn().Err(err).Msg("failed to purge processed activities")
+			}
+		}
+	}
+}
+
+// dumpActor writes the actor document we serve for name, a pubkey or "instance", followed by its public key.
+func dumpActor(ctx context.Context, w io.Writer, nostrService NostrProvider, name string) error {
+	var actor Actor
+	if name == instanceActorName {
+		actor = instanceActor(s)
+	} else {
+		pubkey, err := decodeNIP19(name, "npub")
+		if err != nil {
+			return err
+		}
+
+		// without metadata from the relays we can still show everything that doesn't come from it
+		metadata, err := nostrService.GetMetadataByPubKey(ctx, pubkey)
+		if err != nil {
+			log.Warn().Err(err).Msg("couldn't get metadata, dumping the actor without it")
+			metadata = &nostr.Event{PubKey: pubkey, Kind: 0, Content: "{}"}
+		}
+		actor = nostrService.EventToActor(ctx, *metadata)
+	}
 
-	relayer.Router.PathPrefix("/").Methods("GET").Handler(http.FileServer(http.Dir("./static")))
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(actor); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprint(w, actor.PublicKey.PublicKeyPEM)
+	return err
+}
 
-	// start the relay/http server
-	relayer.Start(relay)
+// retry calls fn until it succeeds, doubling the wait between attempts, and gives up after the given number of
+// attempts or when ctx is cancelled.
+func retry(ctx context.Context, attempts int, wait time.Duration, fn func() error) error {
+	var err error
+	for i := 1; ; i++ {
+		if err = fn(); err == nil || i == attempts {
+			return err
+		}
+
+		log.Warn().Err(err).Int("attempt", i).Dur("wait", wait).Msg("retrying")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// counterVec is a minimal Prometheus-style counter partitioned by a single label.
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	values sync.Map // label value -> *uint64
+}
+
+func newCounterVec(name string, help string, label string) *counterVec {
+	return &counterVec{
+		name:  name,
+		help:  help,
+		label: label,
+	}
+}
+
+func (c *counterVec) Inc(value string) {
+	counter, _ := c.values.LoadOrStore(value, new(uint64))
+	atomic.AddUint64(counter.(*uint64), 1)
+}
+
+// Write writes the counter in the Prometheus text exposition format.
+func (c *counterVec) Write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+
+	var labels []string
+	c.values.Range(func(key, _ any) bool {
+		labels = append(labels, key.(string))
+		return true
+	})
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		counter, _ := c.values.Load(label)
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, label, atomic.LoadUint64(counter.(*uint64)))
+	}
+}
+
+// gauge is a minimal Prometheus-style integer gauge without labels.
+type gauge struct {
+	name  string
+	help  string
+	value int64
+}
+
+func newGauge(name string, help string) *gauge {
+	return &gauge{
+		name: name,
+		help: help,
+	}
+}
+
+func (g *gauge) Set(value int64) {
+	atomic.StoreInt64(&g.value, value)
+}
+
+func (g *gauge) Write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	fmt.Fprintf(w, "%s %d\n", g.name, atomic.LoadInt64(&g.value))
+}
+
+// histogram is a minimal Prometheus-style histogram without labels.
+type histogram struct {
+	name    string
+	help    string
+	bounds  []float64
+	mu      sync.Mutex
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name string, help string, bounds []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Write writes the histogram in the Prometheus text exposition format.
+func (h *histogram) Write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, bound, h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", h.name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// federation metrics, updated from wherever the activity happens
+var (
+	inboxActivities    = newCounterVec("nofed_inbox_activities_total", "Activities received in the inbox.", "type")
+	deliveryResults    = newCounterVec("nofed_deliveries_total", "Outbound deliveries attempted.", "result")
+	conversions        = newCounterVec("nofed_conversions_total", "Objects converted between ActivityPub and nostr.", "conversion")
+	relayPublishes     = newCounterVec("nofed_relay_publishes_total", "Events published to a single relay.", "result")
+	relayQueryDuration = newHistogram("nofed_relay_query_duration_seconds", "Time taken by queries to a single relay.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5})
+)
+
+// inboxActivityType is the label an activity type is counted under, so that remote servers can't make up new ones.
+func inboxActivityType(activityType string) string {
+	switch activityType {
+	case "Create", "Update", "Delete", "Follow", "Undo", "Accept", "Reject", "Like", "EmojiReact", "Announce", "Move":
+		return activityType
+	default:
+		return "other"
+	}
+}
+
+// deliveryResult is the label a delivery that got a response is counted under, its status class.
+func deliveryResult(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+func writeFederationMetrics(w io.Writer) {
+	inboxActivities.Write(w)
+	deliveryResults.Write(w)
+	conversions.Write(w)
+	relayPublishes.Write(w)
+	relayQueryDuration.Write(w)
+}
@@ -0,0 +1,191 @@
+package main
+
+// migrations holds the database schema changes, applied in order by Setup and recorded in schema_migrations.
+// Never edit or reorder an existing migration, append a new one instead.
+var migrations = []string{
+	// 1: initial schema
+	`
+		-- reverse key map of pub profiles
+		CREATE TABLE IF NOT EXISTS keys (
+			pub_actor_url text NOT NULL,
+			nostr_privkey text NOT NULL,
+			nostr_pubkey text PRIMARY KEY
+		);
+		
+		-- pub profiles that are following nostr pubkeys
+		CREATE TABLE IF NOT EXISTS followers (
+			nostr_pubkey text NOT NULL,
+			pub_actor_url text NOT NULL,
+			
+			UNIQUE(nostr_pubkey, pub_actor_url)
+		);
+		CREATE INDEX IF NOT EXISTS pubfollowersidx ON followers (nostr_pubkey);
+		
+		-- reverse map of nostr event ids to pub notes
+		CREATE TABLE IF NOT EXISTS notes (
+			pub_note_url text NOT NULL,
+			nostr_event_id text PRIMARY KEY
+		);
+		
+		-- event cache
+		CREATE TABLE IF NOT EXISTS cache (
+			key text PRIMARY KEY,
+			value text NOT NULL,
+			time timestamp,
+			expiration timestamp
+		);
+
+		CREATE INDEX IF NOT EXISTS prefixmatch ON cache(key text_pattern_ops);
+		CREATE INDEX IF NOT EXISTS cachedeventorder ON cache (time);
+	`,
+	// 2: outbound delivery queue
+	`
+		CREATE TABLE delivery_queue (
+			id bigserial PRIMARY KEY,
+			target_inbox text NOT NULL,
+			key_id text NOT NULL,
+			activity_json text NOT NULL,
+			attempts integer NOT NULL DEFAULT 0,
+			next_attempt_at timestamp NOT NULL DEFAULT now(),
+			created_at timestamp NOT NULL DEFAULT now()
+		);
+		CREATE INDEX deliveryduequeue ON delivery_queue (next_attempt_at);
+	`,
+	// 3: lookups and deletions of notes by their fediverse URL
+	`
+		CREATE INDEX IF NOT EXISTS notes_pub_url_idx ON notes (pub_note_url);
+	`,
+	// 4: thread structure of bridged notes
+	`
+		CREATE TABLE note_threads (
+			nostr_event_id text PRIMARY KEY,
+			in_reply_to text NOT NULL DEFAULT '',
+			root_id text NOT NULL DEFAULT '',
+			event text NOT NULL
+		);
+		CREATE INDEX notethreadsrootidx ON note_threads (root_id);
+	`,
+	// 5: blocked domains and pubkeys
+	`
+		CREATE TABLE blocklist (
+			kind text NOT NULL CHECK (kind IN ('domain', 'pubkey')),
+			value text NOT NULL,
+			created_at timestamp NOT NULL DEFAULT now(),
+
+			PRIMARY KEY (kind, value)
+		);
+	`,
+	// 6: domains we federate with in allowlist mode
+	`
+		CREATE TABLE allowlist (
+			domain text PRIMARY KEY,
+			created_at timestamp NOT NULL DEFAULT now()
+		);
+	`,
+	// 7: pinned notes of bridged actors
+	`
+		CREATE TABLE pins (
+			nostr_pubkey text NOT NULL,
+			nostr_event_id text NOT NULL,
+			position integer NOT NULL,
+
+			PRIMARY KEY (nostr_pubkey, nostr_event_id)
+		);
+	`,
+	// 8: inboxes of the fediverse actors we deal with
+	`
+		CREATE TABLE actors (
+			pub_actor_url text PRIMARY KEY,
+			inbox text NOT NULL,
+			shared_inbox text NOT NULL DEFAULT '',
+			updated_at timestamp NOT NULL DEFAULT now()
+		);
+	`,
+	// 9: fediverse accounts that moved elsewhere
+	`
+		CREATE TABLE actor_moves (
+			old_actor_url text PRIMARY KEY,
+			new_actor_url text NOT NULL,
+			moved_at timestamp NOT NULL DEFAULT now()
+		);
+	`,
+	// 10: how each bridged key was derived, see deriveNostrKey
+	`
+		ALTER TABLE keys ADD COLUMN derivation_version integer NOT NULL DEFAULT 0;
+		CREATE INDEX IF NOT EXISTS keys_pub_actor_url_idx ON keys (pub_actor_url);
+	`,
+	// 11: actors pinned to a fixed keypair, whatever the secret
+	`
+		CREATE TABLE key_overrides (
+			pub_actor_url text PRIMARY KEY,
+			nostr_privkey text NOT NULL,
+			created_at timestamp NOT NULL DEFAULT now()
+		);
+		COMMENT ON COLUMN keys.derivation_version IS
+			'-1: pinned in key_overrides, 0: hex(actor || hmac-sha256(secret, "")), 1: hex(hmac-sha256(secret, 0x01 || actor))';
+	`,
+	// 12: settings generated by the instance itself, like its secret when none is configured
+	`
+		CREATE TABLE instance_settings (
+			key text PRIMARY KEY,
+			value text NOT NULL,
+			created_at timestamp NOT NULL DEFAULT now()
+		);
+	`,
+	// 13: ids of the inbox activities already handled, as the same one often arrives more than once
+	`
+		CREATE TABLE processed_activities (
+			activity_id text PRIMARY KEY,
+			processed_at timestamp NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS processed_activities_processed_at_idx ON processed_activities (processed_at);
+	`,
+	// 14: other accounts the nostr users we bridge declare to also be, for account moves
+	`
+		CREATE TABLE actor_aliases (
+			nostr_pubkey text NOT NULL,
+			alias text NOT NULL,
+			created_at timestamp NOT NULL DEFAULT now(),
+			PRIMARY KEY (nostr_pubkey, alias)
+		);
+	`,
+	// 15: fediverse actors followed on behalf of nostr users, and whether they accepted it
+	`
+		CREATE TABLE remote_follows (
+			nostr_pubkey text NOT NULL,
+			actor_url text NOT NULL,
+			follow_id text NOT NULL UNIQUE,
+			follow_state text NOT NULL DEFAULT 'pending' CHECK (follow_state IN ('pending', 'accepted', 'rejected')),
+			created_at timestamp NOT NULL DEFAULT now(),
+			updated_at timestamp NOT NULL DEFAULT now(),
+			PRIMARY KEY (nostr_pubkey, actor_url)
+		);
+	`,
+	// 16: notes deleted on either side, so that they can be told apart from those that never existed
+	`
+		CREATE TABLE deleted_notes (
+			nostr_event_id text PRIMARY KEY,
+			deleted_at timestamp NOT NULL DEFAULT now()
+		);
+	`,
+	// 17: fediverse relays subscribed to the public notes we bridge
+	`
+		CREATE TABLE relay_subscribers (
+			pub_actor_url text PRIMARY KEY,
+			created_at timestamp NOT NULL DEFAULT now()
+		);
+	`,
+	// 18: public keys of the fediverse actors we deal with, to verify the signatures of what they send us
+	`
+		ALTER TABLE actors ADD COLUMN key_id text NOT NULL DEFAULT '';
+		ALTER TABLE actors ADD COLUMN public_key_pem text NOT NULL DEFAULT '';
+		CREATE INDEX actors_key_id_idx ON actors (key_id);
+	`,
+	// 19: who bridged notes are from, as their URLs needn't be under their author's
+	`
+		ALTER TABLE notes ADD COLUMN nostr_pubkey text NOT NULL DEFAULT '';
+		UPDATE notes SET nostr_pubkey = note_threads.event::json->>'pubkey'
+		FROM note_threads WHERE note_threads.nostr_event_id = notes.nostr_event_id;
+		CREATE INDEX notes_nostr_pubkey_idx ON notes (nostr_pubkey);
+	`,
+}
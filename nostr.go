@@ -1,40 +1,66 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/fiatjaf/litepub"
 	"github.com/nbd-wtf/go-nostr/nip10"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slices"
+	"html"
 	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/yuin/goldmark"
 )
 
 type NostrProvider interface {
-	GetNostrKeysByActor(actor string) (string, string, error)
-	GetEventByID(ID string) (*nostr.Event, error)
-	GetNotesByPubKey(pubkey string) ([]nostr.Event, error)
-	GetFollowersByPubKey(pubkey string) ([]string, error)
-	GetFollowingByPubKey(pubkey string) ([]string, error)
-	GetMetadataByPubKey(pubkey string) (*nostr.Event, error)
-	QuerySync(filter nostr.Filter, max int) []nostr.Event
-
-	EventToNote(event nostr.Event) litepub.Note
-	EventToActor(event nostr.Event) litepub.Actor
+	GetNostrKeysByActor(ctx context.Context, actor string) (string, string, error)
+	GetEventByID(ctx context.Context, ID string) (*nostr.Event, error)
+	GetNotesByPubKey(ctx context.Context, pubkey string, until *time.Time, limit int) ([]nostr.Event, int, error)
+	GetFollowersByPubKey(ctx context.Context, pubkey string, limit int, offset int) ([]string, int, error)
+	GetFollowingByPubKey(ctx context.Context, pubkey string) ([]string, error)
+	GetMetadataByPubKey(ctx context.Context, pubkey string) (*nostr.Event, error)
+	GetEventsByPubKeys(ctx context.Context, pubkeys []string, kinds []int) map[string][]nostr.Event
+	QuerySync(ctx context.Context, filter nostr.Filter, max int) []nostr.Event
+	PublishEvent(ctx context.Context, event nostr.Event) error
+	SeenOn(id string) []string
+	DeliverEvent(ctx context.Context, event nostr.Event)
+	ReachableRelays() int
+	SubscribeForDelivery(ctx context.Context, onContactList func(context.Context, nostr.Event))
+
+	EventToNote(event nostr.Event) Note
+	EventToArticle(event nostr.Event) Note
+	EventToActor(ctx context.Context, event nostr.Event) Actor
 }
 
 type NostrService struct {
 	db       StorageProvider
 	cache    CacheProvider
+	fetcher  FetchProvider
 	settings Settings
 	peers    []string
+	pool     *relayPool
+	// queries holds a slot per QuerySync in flight, so that a burst of requests can't open relay queries without bound
+	queries chan struct{}
+	// fixtures replace the relays in test mode
+	fixtures *Fixtures
+	// seenOn remembers which relays the events we queried came from
+	seenOn *relayHints
+	// delivered holds the events that went through delivery, be they from subscriptions or posted to our relay
+	delivered *seenEvents
 }
 
-func NewNostrService(db StorageProvider, cache CacheProvider, settings Settings) NostrProvider {
+func NewNostrService(db StorageProvider, cache CacheProvider, fetcher FetchProvider, fixtures *Fixtures, settings Settings) NostrProvider {
 	// TODO: It would probably be better to maintain a set of relays in the DB
 	// where we could track their health and remove them if they're down.
 	// We could also add new relays we are seeing when querying the network.
@@ -80,31 +106,160 @@ func NewNostrService(db StorageProvider, cache CacheProvider, settings Settings)
 		"wss://rsslay.fiatjaf.com",
 	}
 
+	if settings.QueryRelayCount > len(peers) {
+		log.Warn().Int("count", settings.QueryRelayCount).Int("peers", len(peers)).
+			Msg("QUERY_RELAY_COUNT is larger than the number of known peers, capping it")
+		settings.QueryRelayCount = len(peers)
+		if settings.QueryMinRelays > settings.QueryRelayCount {
+			settings.QueryMinRelays = settings.QueryRelayCount
+		}
+	}
+
 	return &NostrService{
 		db,
 		cache,
+		fetcher,
 		settings,
 		peers,
+		newRelayPool(),
+		make(chan struct{}, settings.QueryConcurrency),
+		fixtures,
+		&relayHints{relays: make(map[string][]string)},
+		&seenEvents{ids: make(map[string]bool)},
 	}
 }
 
-func (n *NostrService) GetNostrKeysByActor(actor string) (string, string, error) {
-	hash := hmac.New(sha256.New, n.settings.PrivateKey.D.Bytes()).Sum([]byte(actor))
-	privkey := hex.EncodeToString(hash)
-	pubkey, err := nostr.GetPublicKey(privkey)
+func (n *NostrService) GetNostrKeysByActor(ctx context.Context, actor string) (string, string, error) {
+	// the same person can be referred to by different URLs, so make sure we always derive keys from the same one
+	actor, err := n.canonicalActorURL(ctx, actor)
+	if err != nil {
+		// keys we already have are still good, but new ones would be derived from what may be the wrong URL
+		if privkey, pubkey, kerr := n.db.GetNostrKeypairByActorUrl(ctx, actor); kerr == nil && privkey != "" {
+			return privkey, pubkey, nil
+		}
+		return "", "", err
+	}
+
+	// operators can pin an actor to a given keypair, which wins over anything derived
+	if privkey, err := n.db.GetKeyOverride(ctx, actor); err != nil {
+		return "", "", err
+	} else if privkey != "" {
+		pubkey, err := nostr.GetPublicKey(privkey)
+		if err != nil {
+			return "", "", err
+		}
+		if err := n.db.SaveNostrKeypair(ctx, pubkey, privkey, actor, keyOverrideVersion); err != nil {
+			return "", "", err
+		}
+		return privkey, pubkey, nil
+	}
+
+	// keys derived before are reused as they are, whichever version derived them
+	if privkey, pubkey, err := n.db.GetNostrKeypairByActorUrl(ctx, actor); err != nil {
+		return "", "", err
+	} else if privkey != "" {
+		return privkey, pubkey, nil
+	}
+
+	privkey, pubkey, version, err := n.deriveKeypair(ctx, actor)
 	if err != nil {
 		return "", "", err
 	}
 
-	if err = n.db.SaveNostrKeypair(pubkey, privkey, actor); err != nil {
+	if err = n.db.SaveNostrKeypair(ctx, pubkey, privkey, actor, version); err != nil {
 		return "", "", err
 	}
 
 	return privkey, pubkey, nil
 }
 
-func (n *NostrService) GetEventByID(ID string) (*nostr.Event, error) {
-	if event, err := n.cache.GetNoteByID(ID); err == nil {
+// deriveKeypair derives the keypair of an actor we have no key for. Were it derived from one of the previous
+// secrets and already followed, that one is kept, otherwise the actor would lose its followers to the rotation.
+func (n *NostrService) deriveKeypair(ctx context.Context, actor string) (string, string, int, error) {
+	for _, previous := range n.settings.PreviousDerivationKeys {
+		for _, version := range []int{keyDerivationVersion, 0} {
+			privkey, err := deriveNostrKey(previous, actor, version)
+			if err != nil {
+				return "", "", 0, err
+			}
+			pubkey, err := nostr.GetPublicKey(privkey)
+			if err != nil {
+				return "", "", 0, err
+			}
+
+			if followed, err := n.db.HasFollowers(ctx, pubkey); err != nil {
+				return "", "", 0, err
+			} else if followed {
+				log.Info().Str("actor", actor).Str("pubkey", pubkey).Msg("keeping key derived from a previous secret")
+				return privkey, pubkey, version, nil
+			}
+		}
+	}
+
+	privkey, err := deriveNostrKey(n.settings.DerivationKey, actor, keyDerivationVersion)
+	if err != nil {
+		return "", "", 0, err
+	}
+	pubkey, err := nostr.GetPublicKey(privkey)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	return privkey, pubkey, keyDerivationVersion, nil
+}
+
+// canonicalActorURL resolves any URL pointing at an actor to the actor's own id, remembering the result.
+// When the actor can't be fetched it returns the normalized URL along with the error.
+func (n *NostrService) canonicalActorURL(ctx context.Context, actor string) (string, error) {
+	normalized := normalizeActorURL(actor)
+	if strings.HasPrefix(normalized, n.settings.ServiceURL) {
+		// one of our own
+		return normalized, nil
+	}
+
+	if id, err := n.cache.GetActorID(normalized); err == nil && id != "" {
+		return id, nil
+	}
+
+	fetched, err := n.fetcher.FetchActor(normalized)
+	if err != nil {
+		return normalized, err
+	}
+	if fetched.Id == "" {
+		return normalized, fmt.Errorf("actor %s has no id", normalized)
+	}
+	if !sameHost(fetched.Id, normalized) {
+		// or any server could claim to be someone else and get their keys
+		return normalized, fmt.Errorf("actor %s claims to be %s", normalized, fetched.Id)
+	}
+
+	id := normalizeActorURL(fetched.Id)
+	tasks.Go(func() {
+		if err := n.cache.CacheActorID(normalized, id); err != nil {
+			log.Warn().Err(err).Msg("couldn't cache actor id")
+		}
+	})
+
+	return id, nil
+}
+
+// normalizeActorURL lowercases the scheme and host of an actor URL and strips fragments and trailing slashes.
+func normalizeActorURL(actor string) string {
+	parsed, err := url.Parse(strings.TrimSpace(actor))
+	if err != nil || parsed.Host == "" {
+		return strings.TrimSpace(actor)
+	}
+
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+	parsed.Fragment = ""
+	parsed.Path = strings.TrimRight(parsed.Path, "/")
+
+	return parsed.String()
+}
+
+func (n *NostrService) GetEventByID(ctx context.Context, ID string) (*nostr.Event, error) {
+	if event, err := n.cache.GetNoteByID(ID); err == nil && event != nil {
 		return event, nil
 	}
 
@@ -112,70 +267,101 @@ func (n *NostrService) GetEventByID(ID string) (*nostr.Event, error) {
 		IDs: []string{ID},
 	}
 
-	events := n.QuerySync(filter, 1)
+	events := n.QuerySync(ctx, filter, 1)
 	if len(events) == 0 {
-		return nil, fmt.Errorf("event not found")
+		return n.staleFallback(noteKey(ID))
 	}
 
-	go func() {
+	tasks.Go(func() {
 		err := n.cache.CacheEvent(events[0])
 		if err != nil {
 			log.Warn().Err(err).Msg("couldn't cache event")
 		}
-	}()
+	})
 
 	return &events[0], nil
 }
 
-func (n *NostrService) GetNotesByPubKey(pubkey string) ([]nostr.Event, error) {
-	cached, err := n.cache.GetNotesByPubKey(pubkey)
+// GetNotesByPubKey returns up to limit of the pubkey's newest notes, newest first, or the ones older than until to
+// page back through its history, along with how many of its notes we know of in total. Only notes newer than what
+// we have cached are asked from the relays.
+func (n *NostrService) GetNotesByPubKey(ctx context.Context, pubkey string, until *time.Time, limit int) ([]nostr.Event, int, error) {
+	cached, err := n.cache.GetNotesByPubKey(pubkey, until, limit)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	since := time.Date(1971, 1, 1, 0, 0, 0, 0, time.UTC)
-	if len(cached) > 0 {
-		since = cached[0].CreatedAt
+	total, err := n.cache.CountNotesByPubKey(pubkey)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	filter := nostr.Filter{
 		Authors: []string{pubkey},
 		Kinds:   []int{1},
-		Since:   &since,
+		Until:   until,
 	}
 
-	events := n.QuerySync(filter, 50)
+	// the first page only needs what's newer than the cache, older pages can have gaps anywhere
+	if until == nil {
+		since := time.Date(1971, 1, 1, 0, 0, 0, 0, time.UTC)
+		for _, event := range cached {
+			if event.CreatedAt.After(since) {
+				since = event.CreatedAt
+			}
+		}
+		filter.Since = &since
+	}
+
+	events := n.QuerySync(ctx, filter, limit)
 	if len(events) > 0 {
-		go func() {
-			for _, event := range events {
-				err := n.cache.CacheEvent(event)
-				if err != nil {
-					log.Warn().Err(err).Msg(fmt.Sprintf("Failed to cache event with ID: %s", event.ID))
-				}
+		tasks.Go(func() {
+			if err := n.cache.CacheEvents(events); err != nil {
+				log.Warn().Err(err).Msg(fmt.Sprintf("Failed to cache %d events for pubkey: %s", len(events), pubkey))
 			}
-		}()
+		})
 	}
 
-	return append(cached, events...), nil
-}
+	unique := make(map[string]bool, len(cached))
+	for _, event := range cached {
+		unique[event.ID] = true
+	}
+	for _, event := range events {
+		if !unique[event.ID] {
+			cached = append(cached, event)
+			if until == nil {
+				// the relays only gave us notes newer than what we have cached, so these aren't counted yet
+				total++
+			}
+		}
+	}
 
-func (n *NostrService) GetFollowersByPubKey(pubkey string) ([]string, error) {
-	filter := nostr.Filter{
-		Authors: []string{pubkey},
-		Kinds:   []int{3},
+	sort.SliceStable(cached, func(i, j int) bool {
+		return cached[i].CreatedAt.After(cached[j].CreatedAt)
+	})
+	if len(cached) > limit {
+		cached = cached[:limit]
+	}
+	if total < len(cached) {
+		total = len(cached)
 	}
 
-	events := n.QuerySync(filter, 1)
-	if len(events) > 0 {
-		if err := n.db.SaveFollowers(events[0], n.settings.ServiceURL); err != nil {
-			return nil, err
-		}
+	return cached, total, nil
+}
+
+// GetFollowersByPubKey returns a page of the pubkey's followers along with how many there are in total. Those are
+// the fediverse actors that followed it, the contact list is who it follows and says nothing about them.
+func (n *NostrService) GetFollowersByPubKey(ctx context.Context, pubkey string, limit int, offset int) ([]string, int, error) {
+	total, err := n.db.CountFollowersByPubKey(ctx, pubkey)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return n.db.GetFollowersByPubKey(pubkey)
+	followers, err := n.db.GetFollowersByPubKey(ctx, pubkey, limit, offset)
+	return followers, total, err
 }
 
-func (n *NostrService) GetFollowingByPubKey(pubkey string) ([]string, error) {
+func (n *NostrService) GetFollowingByPubKey(ctx context.Context, pubkey string) ([]string, error) {
 	event, err := n.cache.GetContactList(pubkey)
 	if err != nil {
 		return nil, err
@@ -187,7 +373,7 @@ func (n *NostrService) GetFollowingByPubKey(pubkey string) ([]string, error) {
 			Kinds:   []int{3},
 		}
 
-		events := n.QuerySync(filter, 1)
+		events := n.QuerySync(ctx, filter, 1)
 		if len(events) > 0 {
 			if err := n.cache.CacheEvent(events[0]); err != nil {
 				log.Warn().Err(err).Msg("couldn't cache event")
@@ -206,7 +392,7 @@ func (n *NostrService) GetFollowingByPubKey(pubkey string) ([]string, error) {
 	return following, nil
 }
 
-func (n *NostrService) GetMetadataByPubKey(pubkey string) (*nostr.Event, error) {
+func (n *NostrService) GetMetadataByPubKey(ctx context.Context, pubkey string) (*nostr.Event, error) {
 	if event, err := n.cache.GetMetadata(pubkey); err == nil && event != nil {
 		return event, nil
 	}
@@ -216,33 +402,104 @@ func (n *NostrService) GetMetadataByPubKey(pubkey string) (*nostr.Event, error)
 		Kinds:   []int{0},
 	}
 
-	events := n.QuerySync(filter, 1)
+	events := n.QuerySync(ctx, filter, 1)
 	if len(events) == 0 {
-		return nil, fmt.Errorf("event not found")
+		return n.staleFallback(metadataKey(pubkey))
 	}
 
-	go func() {
+	tasks.Go(func() {
 		err := n.cache.CacheEvent(events[0])
 		if err != nil {
 			log.Warn().Err(err).Msg("couldn't cache event")
 		}
-	}()
+	})
 
 	return &events[0], nil
 }
 
-func (n *NostrService) QuerySync(filter nostr.Filter, max int) []nostr.Event {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// GetEventsByPubKeys asks the relays for events of the given kinds from all of pubkeys in a single query and
+// returns them grouped by author, so that a timeline of many authors costs one round-trip instead of one per author.
+func (n *NostrService) GetEventsByPubKeys(ctx context.Context, pubkeys []string, kinds []int) map[string][]nostr.Event {
+	filter := nostr.Filter{
+		Authors: pubkeys,
+		Kinds:   kinds,
+	}
+
+	events := n.QuerySync(ctx, filter, n.settings.QueryMaxEvents)
+
+	byPubKey := make(map[string][]nostr.Event, len(pubkeys))
+	var cacheable []nostr.Event
+	for _, event := range events {
+		byPubKey[event.PubKey] = append(byPubKey[event.PubKey], event)
+		if event.Kind == 0 || event.Kind == 1 || event.Kind == 3 {
+			cacheable = append(cacheable, event)
+		}
+	}
+
+	if len(cacheable) > 0 {
+		tasks.Go(func() {
+			if err := n.cache.CacheEvents(cacheable); err != nil {
+				log.Warn().Err(err).Int("events", len(cacheable)).Msg("couldn't cache events")
+			}
+		})
+	}
+
+	return byPubKey
+}
+
+// errEventNotFound is returned when neither the relays nor the cache have the event asked for.
+var errEventNotFound = errors.New("event not found")
+
+// staleFallback serves whatever we have cached under key, even if expired, for when the relays didn't give us anything.
+func (n *NostrService) staleFallback(key string) (*nostr.Event, error) {
+	event, err := n.cache.GetStaleEventByKey(key)
+	if err != nil || event == nil || isExpired(*event) {
+		return nil, errEventNotFound
+	}
+
+	log.Info().Str("key", key).Msg("relays returned nothing, serving stale cached event")
+	return event, nil
+}
+
+func (n *NostrService) QuerySync(ctx context.Context, filter nostr.Filter, max int) []nostr.Event {
+	ctx, span := tracer.Start(ctx, "NostrService.QuerySync", trace.WithAttributes(attribute.Int("max", max)))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, n.settings.QueryTimeout)
 	defer cancel()
-	events := make(chan nostr.Event, max*len(n.peers))
-	defer close(events)
 
+	// a single query isn't allowed to ask for more than QueryMaxEvents, however big the profile it is for
+	if max > n.settings.QueryMaxEvents {
+		max = n.settings.QueryMaxEvents
+	}
+	if filter.Limit == 0 || filter.Limit > max {
+		filter.Limit = max
+	}
+
+	if n.fixtures != nil {
+		return n.fixtures.Query(filter, max)
+	}
+
+	select {
+	case n.queries <- struct{}{}:
+		defer func() { <-n.queries }()
+	case <-ctx.Done():
+		log.Warn().Int("concurrency", cap(n.queries)).Msg("too many relay queries in flight, giving up")
+		return nil
+	}
+
+	var unique = map[string]bool{}
+	var filteredEvents []nostr.Event
 	var connectedRelays = make(map[string]*nostr.Relay)
 	var failedConnections = make(map[string]int)
 	rand.Seed(time.Now().Unix())
-	for len(connectedRelays) < 5 &&
+
+	// always ask at least QueryMinRelays relays, and only keep reaching out to more of them (up to QueryRelayCount)
+	// while the ones we've asked so far haven't given us enough events
+	for ctx.Err() == nil &&
 		(len(connectedRelays)+len(failedConnections)) < len(n.peers) &&
-		len(events) < max {
+		(len(connectedRelays) < n.settings.QueryMinRelays ||
+			(len(filteredEvents) < max && len(connectedRelays) < n.settings.QueryRelayCount)) {
 
 		relayUrl := n.peers[rand.Intn(len(n.peers))]
 		if _, previousAttempt := failedConnections[relayUrl]; previousAttempt {
@@ -254,47 +511,199 @@ func (n *NostrService) QuerySync(filter nostr.Filter, max int) []nostr.Event {
 		}
 
 		// Note: This was originally written to be concurrent, but it seems that the relay package may need some amends
-		queryContext, queryCancel := context.WithTimeout(ctx, 2*time.Second)
+		queryContext, queryCancel := context.WithTimeout(ctx, n.settings.RelayQueryTimeout)
 
-		relay, err := nostr.RelayConnect(queryContext, relayUrl)
+		relay, _, err := n.pool.Get(queryContext, relayUrl)
 		if err != nil {
 			failedConnections[relayUrl] = failedConnections[relayUrl] + 1
-			log.Error().Err(err).Msg("Error connecting to relay")
+			log.Debug().Err(err).Str("relay", relayUrl).Msg("Error connecting to relay")
 			queryCancel()
 			continue
 		}
 		connectedRelays[relayUrl] = relay
-		fmt.Printf("Connected to relay %s\n", relayUrl)
-
-		for _, event := range relay.QuerySync(queryContext, filter) {
-			fmt.Printf("Found event: %s\n", event.ID)
-			events <- event
-		}
-		_ = relay.Close()
-		queryCancel()
-	}
-	defer cancel()
-
-	var unique = map[string]bool{}
-	var filteredEvents []nostr.Event
-	for len(filteredEvents) < max {
-		select {
-		case <-ctx.Done():
-			close(events)
-			break
-		case event := <-events:
-			fmt.Printf("Received event: %s\n", event.ID)
+		log.Debug().Str("relay", relayUrl).Msg("connected to relay")
+
+		started := time.Now()
+		_, relaySpan := tracer.Start(queryContext, "Relay.QuerySync", trace.WithAttributes(attribute.String("relay", relayUrl)))
+		events := relay.QuerySync(queryContext, filter)
+		relaySpan.SetAttributes(attribute.Int("events", len(events)))
+		relaySpan.End()
+		relayQueryDuration.Observe(time.Since(started).Seconds())
+
+		for _, event := range events {
+			if isExpired(event) {
+				continue
+			}
+			log.Debug().Str("relay", relayUrl).Str("id", event.ID).Int("kind", event.Kind).Msg("found event")
+			n.seenOn.Add(event.ID, relayUrl)
 			if _, ok := unique[event.ID]; !ok {
 				unique[event.ID] = true
 				filteredEvents = append(filteredEvents, event)
 			}
 		}
+		n.pool.Seen(relayUrl)
+		queryCancel()
+	}
+
+	filteredEvents = rankEvents(filteredEvents)
+	span.SetAttributes(attribute.Int("relays", len(connectedRelays)), attribute.Int("events", len(filteredEvents)))
+	if len(filteredEvents) > max {
+		filteredEvents = filteredEvents[:max]
 	}
 
 	return filteredEvents
 }
 
-func (n *NostrService) EventToNote(event nostr.Event) litepub.Note {
+// PublishEvent sends event to all the relays we know of at once. Some of them failing or rejecting it is expected,
+// so it only fails when none of them took it.
+func (n *NostrService) PublishEvent(ctx context.Context, event nostr.Event) error {
+	ctx, span := tracer.Start(ctx, "NostrService.PublishEvent", trace.WithAttributes(attribute.String("id", event.ID)))
+	defer span.End()
+
+	if n.fixtures != nil {
+		n.fixtures.Publish(event)
+		return nil
+	}
+
+	var mu sync.Mutex
+	results := make(map[string]string, len(n.peers))
+
+	var wg sync.WaitGroup
+	for _, relayUrl := range n.peers {
+		relayUrl := relayUrl
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			publishContext, cancel := context.WithTimeout(ctx, n.settings.RelayQueryTimeout)
+			defer cancel()
+
+			result := "error"
+			if relay, _, err := n.pool.Get(publishContext, relayUrl); err == nil {
+				result = relay.Publish(publishContext, event).String()
+				n.pool.Seen(relayUrl)
+			}
+			relayPublishes.Inc(result)
+
+			mu.Lock()
+			results[relayUrl] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	accepted := 0
+	for _, result := range results {
+		if result == "success" || result == "sent" {
+			accepted++
+		}
+	}
+	span.SetAttributes(attribute.Int("accepted", accepted))
+	log.Debug().Str("id", event.ID).Int("accepted", accepted).Int("relays", len(results)).Msg("published event")
+
+	if accepted == 0 {
+		return fmt.Errorf("no relay accepted event %s", event.ID)
+	}
+
+	return nil
+}
+
+// SeenOn returns the relays we've recently got the event with the given id from, if any.
+func (n *NostrService) SeenOn(id string) []string {
+	return n.seenOn.Get(id)
+}
+
+// ReachableRelays returns how many relays we've been able to talk to recently.
+func (n *NostrService) ReachableRelays() int {
+	return n.pool.Reachable(30 * time.Minute)
+}
+
+// rankEvents orders events newest first, without the same event twice and, for metadata and contact lists,
+// where different relays may hold different versions, keeps only the newest event per pubkey.
+func rankEvents(events []nostr.Event) []nostr.Event {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].CreatedAt.After(events[j].CreatedAt)
+	})
+
+	var seen = map[string]bool{}
+	var latest = map[string]bool{}
+	ranked := events[:0]
+	for _, event := range events {
+		if seen[event.ID] {
+			continue
+		}
+		seen[event.ID] = true
+
+		if event.Kind == 0 || event.Kind == 3 {
+			key := fmt.Sprintf("%d:%s", event.Kind, event.PubKey)
+			if latest[key] {
+				continue
+			}
+			latest[key] = true
+		}
+
+		ranked = append(ranked, event)
+	}
+
+	return ranked
+}
+
+// eventExpiration returns when an event expires according to its NIP-40 "expiration" tag, if it has one.
+func eventExpiration(event nostr.Event) *time.Time {
+	tag := event.Tags.GetFirst([]string{"expiration"})
+	if tag == nil {
+		return nil
+	}
+
+	timestamp, err := strconv.ParseInt(tag.Value(), 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	expiration := time.Unix(timestamp, 0)
+	return &expiration
+}
+
+// isExpired tells whether an event is past its NIP-40 expiration, after which it mustn't be served anymore.
+func isExpired(event nostr.Event) bool {
+	expiration := eventExpiration(event)
+	return expiration != nil && expiration.Before(time.Now())
+}
+
+// relayHints remembers, for the latest events queried, which relays had them.
+type relayHints struct {
+	mu     sync.Mutex
+	relays map[string][]string
+	order  []string
+}
+
+func (h *relayHints) Add(id string, relayUrl string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	relays, known := h.relays[id]
+	if !known {
+		h.order = append(h.order, id)
+		if len(h.order) > 10000 {
+			delete(h.relays, h.order[0])
+			h.order = h.order[1:]
+		}
+	}
+	if !slices.Contains(relays, relayUrl) {
+		h.relays[id] = append(relays, relayUrl)
+	}
+}
+
+func (h *relayHints) Get(id string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]string(nil), h.relays[id]...)
+}
+
+func (n *NostrService) EventToNote(event nostr.Event) Note {
+	conversions.Inc("event_to_note")
+
 	pTags := event.Tags.GetAll([]string{"p", ""})
 	cc := make([]string, len(pTags))
 	for i, tag := range pTags {
@@ -306,46 +715,157 @@ func (n *NostrService) EventToNote(event nostr.Event) litepub.Note {
 		inReplyTo = s.ServiceURL + "/pub/note/" + replyTag.Value()
 	}
 
-	return litepub.Note{
-		Base: litepub.Base{
-			Id:   s.ServiceURL + "/pub/note/" + event.ID,
-			Type: "Note",
+	note := Note{
+		Note: litepub.Note{
+			Base: litepub.Base{
+				Id:   s.ServiceURL + "/pub/note/" + event.ID,
+				Type: "Note",
+			},
+			Published:    event.CreatedAt,
+			AttributedTo: s.ServiceURL + "/pub/user/" + event.PubKey,
+			Content:      n.noteContent(event),
+			InReplyTo:    inReplyTo,
+			To:           []string{"https://www.w3.org/ns/activitystreams#Public"},
+			CC:           cc,
 		},
-		Published:    event.CreatedAt,
-		AttributedTo: s.ServiceURL + "/pub/user/" + event.PubKey,
-		Content:      event.Content,
-		InReplyTo:    inReplyTo,
-		To:           []string{"https://www.w3.org/ns/activitystreams#Public"},
-		CC:           cc,
 	}
+
+	if lang := event.Tags.GetFirst([]string{"l", ""}); lang != nil && len(*lang) > 2 && (*lang)[2] == "ISO-639-1" {
+		note.ContentMap = map[string]string{lang.Value(): note.Content}
+	}
+
+	// a content warning takes the place of the subject, as that's what fediverse clients show in front of it
+	if warning := event.Tags.GetFirst([]string{"content-warning"}); warning != nil {
+		note.Sensitive = true
+		note.Summary = warning.Value()
+		// the warning is shown by fediverse clients already, don't repeat it if we were the ones to inline it
+		note.Content = strings.TrimPrefix(note.Content, contentWarningPrefix(note.Summary))
+		for lang := range note.ContentMap {
+			note.ContentMap[lang] = note.Content
+		}
+	} else if subject := event.Tags.GetFirst([]string{"subject", ""}); subject != nil {
+		note.Summary = subject.Value()
+	}
+
+	// NIP-30 custom emoji, skipping those with no image or that the content doesn't use
+	for _, tag := range event.Tags.GetAll([]string{"emoji", ""}) {
+		if len(tag) < 3 || tag[2] == "" || !isShortcode(tag[1]) || !strings.Contains(note.Content, ":"+tag[1]+":") {
+			continue
+		}
+		note.Tag = append(note.Tag, NoteTag{
+			Type: "Emoji",
+			Name: ":" + tag[1] + ":",
+			Icon: &NoteTagImage{Type: "Image", URL: tag[2]},
+		})
+	}
+
+	return note
 }
 
-func (n *NostrService) EventToActor(event nostr.Event) litepub.Actor {
-	metadata, _ := nostr.ParseMetadata(event)
+// EventToArticle converts a NIP-23 long-form event into an Article, its markdown rendered into HTML.
+func (n *NostrService) EventToArticle(event nostr.Event) Note {
+	conversions.Inc("event_to_article")
 
-	return litepub.Actor{
-		Base: litepub.Base{
-			Id:   s.ServiceURL + "/pub/user/" + event.PubKey,
-			Type: "Person",
-		},
-		URL:                       s.ServiceURL + "/" + event.PubKey,
-		ManuallyApprovesFollowers: false,
-		Published:                 event.CreatedAt,
-		Followers:                 s.ServiceURL + "/pub/user/" + event.PubKey + "/followers",
-		Following:                 s.ServiceURL + "/pub/user/" + event.PubKey + "/following",
-		Inbox:                     s.ServiceURL + "/pub",
-		Outbox:                    s.ServiceURL + "/pub/user/" + event.PubKey + "/outbox",
-		PreferredUsername:         event.PubKey,
-		Name:                      metadata.Name,
-		Summary:                   metadata.About,
-		Icon: litepub.ActorImage{
-			Type: "Image",
-			URL:  metadata.Picture,
+	published := event.CreatedAt
+	if tag := event.Tags.GetFirst([]string{"published_at", ""}); tag != nil {
+		if timestamp, err := strconv.ParseInt(tag.Value(), 10, 64); err == nil {
+			published = time.Unix(timestamp, 0)
+		}
+	}
+
+	article := Note{
+		Note: litepub.Note{
+			Base: litepub.Base{
+				Id:   s.ServiceURL + "/pub/article/" + event.ID,
+				Type: "Article",
+			},
+			Published:    published,
+			AttributedTo: s.ServiceURL + "/pub/user/" + event.PubKey,
+			Content:      renderMarkdown(event.Content),
+			To:           []string{"https://www.w3.org/ns/activitystreams#Public"},
+			CC:           []string{},
 		},
-		PublicKey: litepub.PublicKey{
-			Id:           s.ServiceURL + "/pub/user/" + event.PubKey + "#main-key",
-			Owner:        s.ServiceURL + "/pub/user/" + event.PubKey,
-			PublicKeyPEM: s.PublicKeyPEM,
+	}
+
+	if title := event.Tags.GetFirst([]string{"title", ""}); title != nil {
+		article.Name = title.Value()
+	}
+	if summary := event.Tags.GetFirst([]string{"summary", ""}); summary != nil {
+		article.Summary = summary.Value()
+	}
+
+	return article
+}
+
+// renderMarkdown renders markdown into HTML, leaving out any raw HTML it has.
+func renderMarkdown(md string) string {
+	var b bytes.Buffer
+	if err := goldmark.Convert([]byte(md), &b); err != nil {
+		return html.EscapeString(md)
+	}
+	return b.String()
+}
+
+// noteContent picks the text used as a note's content, falling back to the NIP-31 "alt" tag
+// for events whose content isn't meant to be read by humans, according to AltTagPolicy.
+func (n *NostrService) noteContent(event nostr.Event) string {
+	alt := event.Tags.GetFirst([]string{"alt", ""})
+	if alt == nil || alt.Value() == "" {
+		return event.Content
+	}
+
+	switch n.settings.AltTagPolicy {
+	case "always":
+		return alt.Value()
+	case "fallback":
+		if event.Kind != 1 || strings.TrimSpace(event.Content) == "" {
+			return alt.Value()
+		}
+	}
+
+	return event.Content
+}
+
+func (n *NostrService) EventToActor(ctx context.Context, event nostr.Event) Actor {
+	conversions.Inc("event_to_actor")
+
+	metadata, _ := nostr.ParseMetadata(event)
+	actorUrl := s.ServiceURL + "/pub/user/" + event.PubKey
+
+	aliases, err := n.db.GetAliases(ctx, event.PubKey)
+	if err != nil {
+		log.Warn().Err(err).Str("pubkey", event.PubKey).Msg("failed to get aliases")
+	}
+
+	return Actor{
+		Actor: litepub.Actor{
+			Base: litepub.Base{
+				Id:   s.ServiceURL + "/pub/user/" + event.PubKey,
+				Type: "Person",
+			},
+			URL:                       s.ServiceURL + "/" + event.PubKey,
+			ManuallyApprovesFollowers: false,
+			Published:                 event.CreatedAt,
+			Followers:                 s.ServiceURL + "/pub/user/" + event.PubKey + "/followers",
+			Following:                 s.ServiceURL + "/pub/user/" + event.PubKey + "/following",
+			Inbox:                     s.ServiceURL + "/pub/user/" + event.PubKey + "/inbox",
+			Outbox:                    s.ServiceURL + "/pub/user/" + event.PubKey + "/outbox",
+			PreferredUsername:         event.PubKey,
+			Name:                      metadata.Name,
+			Summary:                   metadata.About,
+			Icon: litepub.ActorImage{
+				Type: "Image",
+				URL:  metadata.Picture,
+			},
+			PublicKey: litepub.PublicKey{
+				Id:           s.ServiceURL + "/pub/user/" + event.PubKey + "#main-key",
+				Owner:        s.ServiceURL + "/pub/user/" + event.PubKey,
+				PublicKeyPEM: s.PublicKeyPEM,
+			},
 		},
+		// the shared inbox saves servers a delivery per follower
+		Endpoints:       &ActorEndpoints{SharedInbox: s.ServiceURL + "/pub"},
+		AlsoKnownAs:     aliases,
+		AssertionMethod: multikeys(actorUrl, s.PublicKeyMultibase),
 	}
 }
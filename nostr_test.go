@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+func TestRankEvents(t *testing.T) {
+	at := func(seconds int64) time.Time { return time.Unix(1700000000+seconds, 0) }
+
+	for _, test := range []struct {
+		name   string
+		events []nostr.Event
+		want   []string
+	}{
+		{
+			"newest first",
+			[]nostr.Event{
+				{ID: "old", Kind: 1, CreatedAt: at(0)},
+				{ID: "new", Kind: 1, CreatedAt: at(20)},
+				{ID: "mid", Kind: 1, CreatedAt: at(10)},
+			},
+			[]string{"new", "mid", "old"},
+		},
+		{
+			"same event from several relays",
+			[]nostr.Event{
+				// what a first relay answered, then a second one
+				{ID: "a", Kind: 1, CreatedAt: at(10)},
+				{ID: "b", Kind: 1, CreatedAt: at(0)},
+				{ID: "b", Kind: 1, CreatedAt: at(0)},
+				{ID: "a", Kind: 1, CreatedAt: at(10)},
+				{ID: "c", Kind: 1, CreatedAt: at(5)},
+			},
+			[]string{"a", "c", "b"},
+		},
+		{
+			"only the newest metadata and contact list of a pubkey",
+			[]nostr.Event{
+				{ID: "meta-old", Kind: 0, PubKey: "p1", CreatedAt: at(0)},
+				{ID: "meta-new", Kind: 0, PubKey: "p1", CreatedAt: at(10)},
+				{ID: "meta-other", Kind: 0, PubKey: "p2", CreatedAt: at(5)},
+				{ID: "contacts-old", Kind: 3, PubKey: "p1", CreatedAt: at(1)},
+				{ID: "contacts-new", Kind: 3, PubKey: "p1", CreatedAt: at(2)},
+			},
+			[]string{"meta-new", "meta-other", "contacts-new"},
+		},
+		{
+			"notes of a pubkey are all kept",
+			[]nostr.Event{
+				{ID: "n1", Kind: 1, PubKey: "p1", CreatedAt: at(0)},
+				{ID: "n2", Kind: 1, PubKey: "p1", CreatedAt: at(1)},
+			},
+			[]string{"n2", "n1"},
+		},
+		{
+			"nothing",
+			nil,
+			[]string{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ranked := rankEvents(test.events)
+
+			got := make([]string, len(ranked))
+			for i, event := range ranked {
+				got[i] = event.ID
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQuerySyncEscalatesWhileRelaysHaveNothing(t *testing.T) {
+	note := signedNote(t, "hello")
+
+	for _, test := range []struct {
+		name  string
+		have  []bool
+		asked int32
+	}{
+		// the first relays answering with the note is enough
+		{"found right away", []bool{true, true, true, true}, 1},
+		// nobody having it, we ask all the relays we're allowed to
+		{"found nowhere", []bool{false, false, false, false}, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var relays []*mockRelay
+			var peers []string
+			for _, has := range test.have {
+				var events []nostr.Event
+				if has {
+					events = append(events, note)
+				}
+				relay := newMockRelay(t, events...)
+				relays = append(relays, relay)
+				peers = append(peers, relay.url)
+			}
+
+			n := &NostrService{
+				settings: Settings{
+					QueryTimeout:      5 * time.Second,
+					RelayQueryTimeout: time.Second,
+					QueryMinRelays:    1,
+					QueryRelayCount:   3,
+					QueryMaxEvents:    10,
+				},
+				peers:   peers,
+				pool:    newRelayPool(),
+				queries: make(chan struct{}, 1),
+				seenOn:  &relayHints{relays: make(map[string][]string)},
+			}
+
+			events := n.QuerySync(context.Background(), nostr.Filter{IDs: []string{note.ID}}, 1)
+			var asked int32
+			for _, relay := range relays {
+				asked += atomic.LoadInt32(&relay.asked)
+			}
+			if asked != test.asked {
+				t.Errorf("asked %d relays, want %d", asked, test.asked)
+			}
+			found := len(events) == 1 && events[0].ID == note.ID
+			if found != test.have[0] {
+				t.Errorf("got %d events, want the note: %v", len(events), test.have[0])
+			}
+		})
+	}
+}
+
+// mockRelay is a relay serving events to whatever subscription it's asked for, it counts the subscriptions in
+// asked and hands what's published to it to published.
+type mockRelay struct {
+	url       string
+	asked     int32
+	published chan nostr.Event
+}
+
+func newMockRelay(t *testing.T, events ...nostr.Event) *mockRelay {
+	relay := &mockRelay{published: make(chan nostr.Event, 10)}
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			var message []json.RawMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+
+			var kind string
+			if len(message) < 2 || json.Unmarshal(message[0], &kind) != nil {
+				continue
+			}
+
+			switch kind {
+			case "REQ":
+				var id string
+				json.Unmarshal(message[1], &id)
+				atomic.AddInt32(&relay.asked, 1)
+
+				for _, event := range events {
+					conn.WriteJSON([]interface{}{"EVENT", id, event})
+				}
+				conn.WriteJSON([]interface{}{"EOSE", id})
+			case "EVENT":
+				var event nostr.Event
+				if err := json.Unmarshal(message[1], &event); err != nil {
+					continue
+				}
+				relay.published <- event
+				conn.WriteJSON([]interface{}{"OK", event.ID, true, ""})
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	relay.url = "ws" + strings.TrimPrefix(server.URL, "http")
+	return relay
+}
+
+func signedNote(t *testing.T, content string) nostr.Event {
+	privkey := "0000000000000000000000000000000000000000000000000000000000000001"
+	pubkey, err := nostr.GetPublicKey(privkey)
+	if err != nil {
+		t.Fatalf("couldn't get public key: %v", err)
+	}
+
+	event := nostr.Event{
+		PubKey:    pubkey,
+		Kind:      1,
+		CreatedAt: time.Unix(1700000000, 0),
+		Tags:      nostr.Tags{},
+		Content:   content,
+	}
+	if err := event.Sign(privkey); err != nil {
+		t.Fatalf("couldn't sign note: %v", err)
+	}
+
+	return event
+}
+
+func TestNoteContentAltTag(t *testing.T) {
+	withAlt := nostr.Tags{{"alt", "a picture of a cat"}}
+
+	for _, test := range []struct {
+		name   string
+		policy string
+		event  nostr.Event
+		want   string
+	}{
+		{"no alt tag", "always", nostr.Event{Kind: 1, Content: "hello"}, "hello"},
+		{"empty alt tag", "always", nostr.Event{Kind: 1, Content: "hello", Tags: nostr.Tags{{"alt", ""}}}, "hello"},
+		{"always", "always", nostr.Event{Kind: 1, Content: "hello", Tags: withAlt}, "a picture of a cat"},
+		{"never", "never", nostr.Event{Kind: 1063, Content: "", Tags: withAlt}, ""},
+		{"fallback for a note", "fallback", nostr.Event{Kind: 1, Content: "hello", Tags: withAlt}, "hello"},
+		{"fallback for an empty note", "fallback", nostr.Event{Kind: 1, Content: " \n", Tags: withAlt}, "a picture of a cat"},
+		{"fallback for another kind", "fallback", nostr.Event{Kind: 1063, Content: "{\"url\":\"x\"}", Tags: withAlt}, "a picture of a cat"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			n := &NostrService{settings: Settings{AltTagPolicy: test.policy}}
+			if got := n.noteContent(test.event); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
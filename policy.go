@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FederationPolicy decides which domains and pubkeys we're willing to deal with. It keeps an in-memory copy
+// of the blocklist and allowlist so that checks don't hit the database, which Reload refreshes.
+type FederationPolicy struct {
+	db       StorageProvider
+	settings Settings
+
+	mu      sync.RWMutex
+	domains []string
+	pubkeys map[string]bool
+	allowed []string
+}
+
+func NewFederationPolicy(db StorageProvider, settings Settings) *FederationPolicy {
+	return &FederationPolicy{
+		db:       db,
+		settings: settings,
+		pubkeys:  make(map[string]bool),
+	}
+}
+
+// Reload reads the blocklist and allowlist again from the database.
+func (p *FederationPolicy) Reload(ctx context.Context) error {
+	entries, err := p.db.GetBlocklist(ctx)
+	if err != nil {
+		return err
+	}
+
+	allowed, err := p.db.GetAllowlist(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range allowed {
+		allowed[i] = strings.ToLower(allowed[i])
+	}
+
+	var domains []string
+	pubkeys := make(map[string]bool)
+	for _, entry := range entries {
+		switch entry.Kind {
+		case "domain":
+			domains = append(domains, strings.ToLower(entry.Value))
+		case "pubkey":
+			pubkeys[strings.ToLower(entry.Value)] = true
+		}
+	}
+
+	p.mu.Lock()
+	p.domains = domains
+	p.pubkeys = pubkeys
+	p.allowed = allowed
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Run reloads the policy every so often until ctx is cancelled, so that changes to the
+// tables are picked up without a restart.
+func (p *FederationPolicy) Run(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.Reload(ctx); err != nil {
+				log.Warn().Err(err).Msg("failed to reload federation policy")
+			}
+		}
+	}
+}
+
+// AllowsDomain tells whether we federate with host: it must not be blocked and, in allowlist mode,
+// it must be on the allowlist. Our own host is always allowed.
+func (p *FederationPolicy) AllowsDomain(host string) bool {
+	host = strings.ToLower(host)
+	if own, err := url.Parse(p.settings.ServiceURL); err == nil && strings.EqualFold(own.Hostname(), host) {
+		return true
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if matchesDomain(p.domains, host) {
+		return false
+	}
+
+	return p.settings.FederationMode != "allowlist" || matchesDomain(p.allowed, host)
+}
+
+// AllowsURL tells whether we federate with the instance hosting u, be it an actor, a note or an inbox.
+func (p *FederationPolicy) AllowsURL(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Hostname() == "" {
+		return p.settings.FederationMode != "allowlist"
+	}
+
+	return p.AllowsDomain(parsed.Hostname())
+}
+
+func (p *FederationPolicy) BlocksPubKey(pubkey string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.pubkeys[strings.ToLower(pubkey)]
+}
+
+// matchesDomain tells whether host is in domains, either exactly or through a "*.example.com" wildcard.
+func matchesDomain(domains []string, host string) bool {
+	for _, domain := range domains {
+		if domain == host {
+			return true
+		}
+		if strings.HasPrefix(domain, "*.") && strings.HasSuffix(host, domain[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
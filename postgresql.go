@@ -1,85 +1,151 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/nbd-wtf/go-nostr"
+	"sort"
+	"time"
 )
 
 type StorageProvider interface {
-	Setup() error
-	GetPubKeyByActorUrl(actorUrl string) (string, error)
-	FollowNostrPubKey(pubActorUrl string, nostrPubkey string) error
-	UnfollowNostrPubKey(pubActorUrl string, nostrPubkey string) error
-	GetFollowersByPubKey(nostrPubkey string) ([]string, error)
-	GetNoteURLByEventID(eventID string) (string, error)
-	GetEventIDByNoteURL(noteUrl string) (string, error)
-	GetActorURLByPubKey(pubkey string) (string, error)
-	SaveNote(nostrEventId string, pubNoteUrl string) error
-	DeleteNoteByUrl(pubNoteUrl string) error
-	SaveFollowers(event nostr.Event, serviceUrl string) error
-	SaveNostrKeypair(nostrPubkey string, nostrPrivkey string, pubActorUrl string) error
+	Setup(ctx context.Context) error
+	GetPubKeyByActorUrl(ctx context.Context, actorUrl string) (string, error)
+	FollowNostrPubKey(ctx context.Context, pubActorUrl string, nostrPubkey string) error
+	UnfollowNostrPubKey(ctx context.Context, pubActorUrl string, nostrPubkey string) error
+	GetFollowersByPubKey(ctx context.Context, nostrPubkey string, limit int, offset int) ([]string, error)
+	CountFollowersByPubKey(ctx context.Context, nostrPubkey string) (int, error)
+	GetNoteURLByEventID(ctx context.Context, eventID string) (string, error)
+	GetEventIDByNoteURL(ctx context.Context, noteUrl string) (string, error)
+	GetNoteAuthor(ctx context.Context, noteUrl string) (string, string, error)
+	GetActorURLByPubKey(ctx context.Context, pubkey string) (string, error)
+	SaveNote(ctx context.Context, nostrEventId string, nostrPubkey string, pubNoteUrl string) error
+	SaveNoteThread(ctx context.Context, event nostr.Event, inReplyTo string, rootID string) error
+	GetThreadRootID(ctx context.Context, eventID string) (string, error)
+	GetThreadByRootID(ctx context.Context, rootID string) ([]nostr.Event, error)
+	DeleteNoteByUrl(ctx context.Context, pubNoteUrl string) (string, error)
+	DeleteNote(ctx context.Context, eventID string) error
+	SaveNoteDeletion(ctx context.Context, eventID string) error
+	GetNoteDeletion(ctx context.Context, eventID string) (time.Time, error)
+	DeleteActor(ctx context.Context, pubActorUrl string, nostrPubkey string) error
+	SaveNostrKeypair(ctx context.Context, nostrPubkey string, nostrPrivkey string, pubActorUrl string, derivationVersion int) error
+	GetNostrKeypairByActorUrl(ctx context.Context, pubActorUrl string) (string, string, error)
+	GetKeyOverride(ctx context.Context, pubActorUrl string) (string, error)
+	HasFollowers(ctx context.Context, nostrPubkey string) (bool, error)
+	GetInstanceSetting(ctx context.Context, key string) (string, error)
+	SaveInstanceSetting(ctx context.Context, key string, value string) (string, error)
+	EnqueueDelivery(ctx context.Context, targetInbox string, keyId string, activity []byte) error
+	ClaimDueDeliveries(ctx context.Context, limit int, lease time.Duration) ([]Delivery, error)
+	RescheduleDelivery(ctx context.Context, id int64, nextAttempt time.Time) error
+	RemoveDelivery(ctx context.Context, id int64) error
+	SaveActor(ctx context.Context, actor *Actor) error
+	GetActorKey(ctx context.Context, keyId string) (string, string, error)
+	GetFollowerInboxes(ctx context.Context, nostrPubkey string) ([]string, error)
+	SaveRelaySubscriber(ctx context.Context, pubActorUrl string) error
+	DeleteRelaySubscriber(ctx context.Context, pubActorUrl string) error
+	GetRelayInboxes(ctx context.Context) ([]string, error)
+	GetPubKeysWithFollowers(ctx context.Context) ([]string, error)
+	SaveActorMove(ctx context.Context, oldActorUrl string, newActorUrl string) error
+	SavePins(ctx context.Context, nostrPubkey string, eventIDs []string) error
+	GetPins(ctx context.Context, nostrPubkey string) ([]string, error)
+	SaveAliases(ctx context.Context, nostrPubkey string, aliases []string) error
+	SaveRemoteFollow(ctx context.Context, nostrPubkey string, actorUrl string, followId string) error
+	GetRemoteFollows(ctx context.Context, nostrPubkey string) ([]string, error)
+	DeleteRemoteFollow(ctx context.Context, nostrPubkey string, actorUrl string) (string, error)
+	SetRemoteFollowState(ctx context.Context, followId string, actorUrl string, state string) (bool, error)
+	GetAliases(ctx context.Context, nostrPubkey string) ([]string, error)
+	GetBlocklist(ctx context.Context) ([]BlocklistEntry, error)
+	GetAllowlist(ctx context.Context) ([]string, error)
+	MarkActivityProcessed(ctx context.Context, activityId string) (bool, error)
+	ForgetActivity(ctx context.Context, activityId string) error
+	PurgeProcessedActivities(ctx context.Context, before time.Time) error
+	Ping(ctx context.Context) error
+}
+
+// Delivery is an activity waiting to be POSTed to a remote inbox.
+type Delivery struct {
+	ID           int64  `db:"id"`
+	TargetInbox  string `db:"target_inbox"`
+	KeyID        string `db:"key_id"`
+	ActivityJSON string `db:"activity_json"`
+	Attempts     int    `db:"attempts"`
+}
+
+// BlocklistEntry is either a domain (possibly a "*.example.com" wildcard) or a nostr pubkey we refuse to deal with.
+type BlocklistEntry struct {
+	Kind  string `db:"kind"`
+	Value string `db:"value"`
 }
 
 type Database struct {
 	conn *sqlx.DB
 }
 
-func NewDatabase(dbUrl string) StorageProvider {
-	conn, err := sqlx.Connect("postgres", dbUrl)
-	if err != nil {
-		panic(err)
-	}
-
+func NewDatabase(conn *sqlx.DB) StorageProvider {
 	return &Database{
 		conn,
 	}
 }
 
-func (db *Database) Setup() error {
-	_, err := db.conn.Exec(`
-		-- reverse key map of pub profiles
-		CREATE TABLE IF NOT EXISTS keys (
-			pub_actor_url text NOT NULL,
-			nostr_privkey text NOT NULL,
-			nostr_pubkey text PRIMARY KEY
-		);
-		
-		-- pub profiles that are following nostr pubkeys
-		CREATE TABLE IF NOT EXISTS followers (
-			nostr_pubkey text NOT NULL,
-			pub_actor_url text NOT NULL,
-			
-			UNIQUE(nostr_pubkey, pub_actor_url)
-		);
-		CREATE INDEX IF NOT EXISTS pubfollowersidx ON followers (nostr_pubkey);
-		
-		-- reverse map of nostr event ids to pub notes
-		CREATE TABLE IF NOT EXISTS notes (
-			pub_note_url text NOT NULL,
-			nostr_event_id text PRIMARY KEY
-		);
-		
-		-- event cache
-		CREATE TABLE IF NOT EXISTS cache (
-			key text PRIMARY KEY,
-			value text NOT NULL,
-			time timestamp,
-			expiration timestamp
+// Setup brings the schema up to date by applying, in order, every migration that hasn't been applied yet.
+func (db *Database) Setup(ctx context.Context) error {
+	if _, err := db.conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version integer PRIMARY KEY,
+			applied_at timestamp NOT NULL DEFAULT now()
 		);
+		`); err != nil {
+		return err
+	}
 
-		CREATE INDEX IF NOT EXISTS prefixmatch ON cache(key text_pattern_ops);
-		CREATE INDEX IF NOT EXISTS cachedeventorder ON cache (time);
-		`)
+	for i, migration := range migrations {
+		if err := db.migrate(ctx, i+1, migration); err != nil {
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+	}
 
-	return err
+	return nil
+}
+
+func (db *Database) migrate(ctx context.Context, version int, migration string) error {
+	tx, err := db.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// make sure concurrently starting instances don't apply the same migration twice
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(7447)"); err != nil {
+		return err
+	}
+
+	var applied bool
+	if err := tx.GetContext(ctx, &applied, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", version); err != nil {
+		return err
+	}
+
+	if applied {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, migration); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (db *Database) GetPubKeyByActorUrl(actorUrl string) (string, error) {
+func (db *Database) GetPubKeyByActorUrl(ctx context.Context, actorUrl string) (string, error) {
 	var pubkey string
-	err := db.conn.Get(&pubkey, "SELECT nostr_pubkey FROM keys WHERE pub_actor_url = $1", actorUrl)
+	err := db.conn.GetContext(ctx, &pubkey, "SELECT nostr_pubkey FROM keys WHERE pub_actor_url = $1 ORDER BY derivation_version LIMIT 1", actorUrl)
 	if err == sql.ErrNoRows {
 		err = nil
 	}
@@ -87,8 +153,8 @@ func (db *Database) GetPubKeyByActorUrl(actorUrl string) (string, error) {
 	return pubkey, err
 }
 
-func (db *Database) FollowNostrPubKey(pubActorUrl string, nostrPubkey string) error {
-	_, err := db.conn.Exec(`
+func (db *Database) FollowNostrPubKey(ctx context.Context, pubActorUrl string, nostrPubkey string) error {
+	_, err := db.conn.ExecContext(ctx, `
 		INSERT INTO followers (nostr_pubkey, pub_actor_url)
 		VALUES ($1, $2)
 		ON CONFLICT (nostr_pubkey, pub_actor_url) DO NOTHING`,
@@ -97,99 +163,586 @@ func (db *Database) FollowNostrPubKey(pubActorUrl string, nostrPubkey string) er
 	return err
 }
 
-func (db *Database) UnfollowNostrPubKey(pubActorUrl string, nostrPubkey string) error {
-	_, err := db.conn.Exec("DELETE FROM followers WHERE nostr_pubkey = $1 AND pub_actor_url = $2", nostrPubkey, pubActorUrl)
+func (db *Database) UnfollowNostrPubKey(ctx context.Context, pubActorUrl string, nostrPubkey string) error {
+	_, err := db.conn.ExecContext(ctx, "DELETE FROM followers WHERE nostr_pubkey = $1 AND pub_actor_url = $2", nostrPubkey, pubActorUrl)
 
 	return err
 }
 
-func (db *Database) GetFollowersByPubKey(nostrPubkey string) ([]string, error) {
+func (db *Database) GetFollowersByPubKey(ctx context.Context, nostrPubkey string, limit int, offset int) ([]string, error) {
 	var followers []string
-	if err := db.conn.Select(&followers, `
+	if err := db.conn.SelectContext(ctx, &followers, `
 		SELECT pub_actor_url 
 		FROM followers 
-		WHERE nostr_pubkey = $1`,
-		nostrPubkey); err != nil && err != sql.ErrNoRows {
+		WHERE nostr_pubkey = $1
+		ORDER BY pub_actor_url
+		LIMIT $2 OFFSET $3`,
+		nostrPubkey, limit, offset); err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
 
 	return followers, nil
 }
 
-func (db *Database) GetNoteURLByEventID(eventID string) (string, error) {
+func (db *Database) CountFollowersByPubKey(ctx context.Context, nostrPubkey string) (int, error) {
+	var count int
+	err := db.conn.GetContext(ctx, &count, "SELECT count(*) FROM followers WHERE nostr_pubkey = $1", nostrPubkey)
+
+	return count, err
+}
+
+func (db *Database) GetNoteURLByEventID(ctx context.Context, eventID string) (string, error) {
 	var noteUrl string
-	if err := db.conn.Get(&noteUrl, "SELECT pub_note_url FROM notes WHERE nostr_event_id = $1", eventID); err != nil && err != sql.ErrNoRows {
+	if err := db.conn.GetContext(ctx, &noteUrl, "SELECT pub_note_url FROM notes WHERE nostr_event_id = $1", eventID); err != nil && err != sql.ErrNoRows {
 		return "", err
 	}
 
 	return noteUrl, nil
 }
 
-func (db *Database) GetEventIDByNoteURL(noteUrl string) (string, error) {
+func (db *Database) GetEventIDByNoteURL(ctx context.Context, noteUrl string) (string, error) {
 	var eventID string
-	if err := db.conn.Get(&eventID, "SELECT nostr_event_id FROM notes WHERE pub_note_url = $1", noteUrl); err != nil && err != sql.ErrNoRows {
+	if err := db.conn.GetContext(ctx, &eventID, "SELECT nostr_event_id FROM notes WHERE pub_note_url = $1", noteUrl); err != nil && err != sql.ErrNoRows {
 		return "", err
 	}
 
 	return eventID, nil
 }
 
-func (db *Database) GetActorURLByPubKey(pubkey string) (string, error) {
+// GetNoteAuthor returns the id of the event the note at noteUrl was bridged as and the pubkey that signed it,
+// which is empty for notes saved before we recorded it.
+func (db *Database) GetNoteAuthor(ctx context.Context, noteUrl string) (string, string, error) {
+	var note struct {
+		EventID string `db:"nostr_event_id"`
+		PubKey  string `db:"nostr_pubkey"`
+	}
+	if err := db.conn.GetContext(ctx, &note, "SELECT nostr_event_id, nostr_pubkey FROM notes WHERE pub_note_url = $1", noteUrl); err != nil && err != sql.ErrNoRows {
+		return "", "", err
+	}
+
+	return note.EventID, note.PubKey, nil
+}
+
+func (db *Database) GetActorURLByPubKey(ctx context.Context, pubkey string) (string, error) {
 	var actorUrl string
-	if err := db.conn.Get(&actorUrl, "SELECT pub_actor_url FROM keys WHERE nostr_pubkey = $1", pubkey); err != nil && err != sql.ErrNoRows {
+	if err := db.conn.GetContext(ctx, &actorUrl, "SELECT pub_actor_url FROM keys WHERE nostr_pubkey = $1", pubkey); err != nil && err != sql.ErrNoRows {
 		return "", err
 	}
 
 	return actorUrl, nil
 }
 
-func (db *Database) SaveNote(nostrEventId string, pubNoteUrl string) error {
-	_, err := db.conn.Exec(`
-		INSERT INTO notes (nostr_event_id, pub_note_url)
-		VALUES ($1, $2)
+// SaveNote records that the fediverse note pubNoteUrl was bridged as nostrEventId, authored by nostrPubkey.
+func (db *Database) SaveNote(ctx context.Context, nostrEventId string, nostrPubkey string, pubNoteUrl string) error {
+	_, err := db.conn.ExecContext(ctx, `
+		INSERT INTO notes (nostr_event_id, nostr_pubkey, pub_note_url)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (nostr_event_id) DO NOTHING`,
+		nostrEventId, nostrPubkey, pubNoteUrl)
+
+	return err
+}
+
+// SaveNoteThread records where a bridged note sits in its thread, along with the event itself,
+// so that whole threads can be served without going back to the fediverse.
+func (db *Database) SaveNoteThread(ctx context.Context, event nostr.Event, inReplyTo string, rootID string) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.ExecContext(ctx, `
+		INSERT INTO note_threads (nostr_event_id, in_reply_to, root_id, event)
+		VALUES ($1, $2, $3, $4)
 		ON CONFLICT (nostr_event_id) DO NOTHING`,
-		nostrEventId, pubNoteUrl)
+		event.ID, inReplyTo, rootID, string(value))
 
 	return err
 }
 
-func (db *Database) DeleteNoteByUrl(pubNoteUrl string) error {
+// GetThreadRootID returns the id of the note that started the thread the given note is part of.
+func (db *Database) GetThreadRootID(ctx context.Context, eventID string) (string, error) {
+	var rootID string
+	if err := db.conn.GetContext(ctx, &rootID, "SELECT root_id FROM note_threads WHERE nostr_event_id = $1", eventID); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	return rootID, nil
+}
+
+// GetThreadByRootID returns all the replies we know of in the thread started by rootID, oldest first.
+func (db *Database) GetThreadByRootID(ctx context.Context, rootID string) ([]nostr.Event, error) {
+	var blobs []string
+	if err := db.conn.SelectContext(ctx, &blobs, "SELECT event FROM note_threads WHERE root_id = $1", rootID); err != nil {
+		return nil, err
+	}
+
+	events := make([]nostr.Event, 0, len(blobs))
+	for _, blob := range blobs {
+		var event nostr.Event
+		if err := json.Unmarshal([]byte(blob), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].CreatedAt.Before(events[j].CreatedAt)
+	})
+
+	return events, nil
+}
+
+// DeleteNoteByUrl forgets a bridged note and returns the id of the nostr event it was bridged as,
+// or an empty string if we never knew about it.
+func (db *Database) DeleteNoteByUrl(ctx context.Context, pubNoteUrl string) (string, error) {
 	var noteID string
-	if err := db.conn.Get(&noteID, "SELECT nostr_event_id FROM notes WHERE pub_note_url = $1", pubNoteUrl); err != nil {
+	if err := db.conn.GetContext(ctx, &noteID, "SELECT nostr_event_id FROM notes WHERE pub_note_url = $1", pubNoteUrl); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return noteID, db.DeleteNote(ctx, noteID)
+}
+
+// DeleteNote forgets the bridged note that became eventID, along with the cached event, and remembers it's gone.
+func (db *Database) DeleteNote(ctx context.Context, eventID string) error {
+	if _, err := db.conn.ExecContext(ctx, "DELETE FROM notes WHERE nostr_event_id = $1", eventID); err != nil {
 		return err
 	}
 
-	if _, err := db.conn.Exec("DELETE FROM notes WHERE pub_note_url = $1", pubNoteUrl); err != nil {
+	// it's cached under its id and under its author's pubkey too
+	if _, err := db.conn.ExecContext(ctx, "DELETE FROM cache WHERE key = $1 OR key LIKE $2", noteKey(eventID), "1:%:"+eventID); err != nil {
 		return err
 	}
 
-	_, err := db.conn.Exec("DELETE FROM cache WHERE key = $1", fmt.Sprintf("1:%s", noteID))
+	return db.SaveNoteDeletion(ctx, eventID)
+}
+
+// SaveNoteDeletion records that a note was deleted, which is then served as a Tombstone.
+func (db *Database) SaveNoteDeletion(ctx context.Context, eventID string) error {
+	_, err := db.conn.ExecContext(ctx, `
+		INSERT INTO deleted_notes (nostr_event_id) VALUES ($1)
+		ON CONFLICT (nostr_event_id) DO NOTHING`, eventID)
 
 	return err
 }
 
-func (db *Database) SaveFollowers(event nostr.Event, serviceUrl string) error {
-	followers := event.Tags.GetAll([]string{"p"})
-	for _, follower := range followers {
-		actorUrl := fmt.Sprintf("%s@%s", follower.Value(), serviceUrl)
-		if _, err := db.conn.Exec(`
-			INSERT INTO followers(nostr_pubkey, pub_actor_url)
-			VALUES ($1, $2)
-			ON CONFLICT (nostr_pubkey, pub_actor_url) DO NOTHING
-		`, event.PubKey, actorUrl); err != nil && err != sql.ErrNoRows {
+// GetNoteDeletion returns when a note was deleted, or sql.ErrNoRows if it wasn't.
+func (db *Database) GetNoteDeletion(ctx context.Context, eventID string) (time.Time, error) {
+	var deletedAt time.Time
+	err := db.conn.GetContext(ctx, &deletedAt, "SELECT deleted_at FROM deleted_notes WHERE nostr_event_id = $1", eventID)
+	return deletedAt, err
+}
+
+// DeleteActor purges everything we know about a deleted fediverse account: its keypair, the follows in both
+// directions, the notes we've bridged from it and any cached events.
+func (db *Database) DeleteActor(ctx context.Context, pubActorUrl string, nostrPubkey string) error {
+	tx, err := db.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// notes saved before we recorded their author only have their URL to go by
+	var noteIDs []string
+	if err := tx.SelectContext(ctx, &noteIDs, `
+		DELETE FROM notes
+		WHERE nostr_pubkey = $2
+		OR (nostr_pubkey = '' AND left(pub_note_url, length($1) + 1) = $1 || '/')
+		RETURNING nostr_event_id`,
+		pubActorUrl, nostrPubkey); err != nil {
+		return err
+	}
+
+	keys := []string{metadataKey(nostrPubkey), contactListKey(nostrPubkey)}
+	for _, id := range noteIDs {
+		keys = append(keys, noteKey(id))
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM cache WHERE key = ANY($1) OR key LIKE '1:' || $2 || ':%'", pq.Array(keys), nostrPubkey); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM followers WHERE pub_actor_url = $1 OR nostr_pubkey = $2", pubActorUrl, nostrPubkey); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM pins WHERE nostr_pubkey = $1", nostrPubkey); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM keys WHERE pub_actor_url = $1", pubActorUrl); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *Database) SaveNostrKeypair(ctx context.Context, nostrPubkey string, nostrPrivkey string, pubActorUrl string, derivationVersion int) error {
+	_, err := db.conn.ExecContext(ctx, `
+        INSERT INTO keys (pub_actor_url, nostr_privkey, nostr_pubkey, derivation_version)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT DO NOTHING
+    `, pubActorUrl, nostrPrivkey, nostrPubkey, derivationVersion)
+
+	return err
+}
+
+func (db *Database) GetInstanceSetting(ctx context.Context, key string) (string, error) {
+	var value string
+	err := db.conn.GetContext(ctx, &value, "SELECT value FROM instance_settings WHERE key = $1", key)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+
+	return value, err
+}
+
+// SaveInstanceSetting stores value under key unless something already is, and returns whatever ends up stored.
+func (db *Database) SaveInstanceSetting(ctx context.Context, key string, value string) (string, error) {
+	if _, err := db.conn.ExecContext(ctx, `
+        INSERT INTO instance_settings (key, value)
+        VALUES ($1, $2)
+        ON CONFLICT (key) DO NOTHING
+    `, key, value); err != nil {
+		return "", err
+	}
+
+	return db.GetInstanceSetting(ctx, key)
+}
+
+// GetKeyOverride returns the private key an actor is pinned to, if any.
+func (db *Database) GetKeyOverride(ctx context.Context, pubActorUrl string) (string, error) {
+	var privkey string
+	err := db.conn.GetContext(ctx, &privkey, "SELECT nostr_privkey FROM key_overrides WHERE pub_actor_url = $1", pubActorUrl)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+
+	return privkey, err
+}
+
+func (db *Database) HasFollowers(ctx context.Context, nostrPubkey string) (bool, error) {
+	var followed bool
+	err := db.conn.GetContext(ctx, &followed, "SELECT EXISTS (SELECT 1 FROM followers WHERE nostr_pubkey = $1)", nostrPubkey)
+	return followed, err
+}
+
+// GetNostrKeypairByActorUrl returns the keypair previously saved for a fediverse actor, or empty strings if there's none.
+func (db *Database) GetNostrKeypairByActorUrl(ctx context.Context, pubActorUrl string) (string, string, error) {
+	var keypair struct {
+		Privkey string `db:"nostr_privkey"`
+		Pubkey  string `db:"nostr_pubkey"`
+	}
+	err := db.conn.GetContext(ctx, &keypair, "SELECT nostr_privkey, nostr_pubkey FROM keys WHERE pub_actor_url = $1 ORDER BY derivation_version LIMIT 1", pubActorUrl)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+
+	return keypair.Privkey, keypair.Pubkey, err
+}
+
+func (db *Database) EnqueueDelivery(ctx context.Context, targetInbox string, keyId string, activity []byte) error {
+	_, err := db.conn.ExecContext(ctx, `
+		INSERT INTO delivery_queue (target_inbox, key_id, activity_json)
+		VALUES ($1, $2, $3)`,
+		targetInbox, keyId, string(activity))
+
+	return err
+}
+
+// ClaimDueDeliveries picks deliveries that are due and pushes their next attempt forward by lease,
+// so that they aren't picked again while being delivered. Each claim counts as an attempt.
+func (db *Database) ClaimDueDeliveries(ctx context.Context, limit int, lease time.Duration) ([]Delivery, error) {
+	var deliveries []Delivery
+	err := db.conn.SelectContext(ctx, &deliveries, `
+		UPDATE delivery_queue
+		SET attempts = attempts + 1, next_attempt_at = now() + $2 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM delivery_queue
+			WHERE next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, target_inbox, key_id, activity_json, attempts`,
+		limit, lease.Seconds())
+
+	return deliveries, err
+}
+
+func (db *Database) RescheduleDelivery(ctx context.Context, id int64, nextAttempt time.Time) error {
+	_, err := db.conn.ExecContext(ctx, "UPDATE delivery_queue SET next_attempt_at = $2 WHERE id = $1", id, nextAttempt)
+
+	return err
+}
+
+func (db *Database) RemoveDelivery(ctx context.Context, id int64) error {
+	_, err := db.conn.ExecContext(ctx, "DELETE FROM delivery_queue WHERE id = $1", id)
+
+	return err
+}
+
+// SaveActor remembers where to deliver activities for a fediverse actor.
+func (db *Database) SaveActor(ctx context.Context, actor *Actor) error {
+	sharedInbox := ""
+	if actor.Endpoints != nil {
+		sharedInbox = actor.Endpoints.SharedInbox
+	}
+
+	_, err := db.conn.ExecContext(ctx, `
+		INSERT INTO actors (pub_actor_url, inbox, shared_inbox, key_id, public_key_pem, updated_at)
+		VALUES ($1, $2, $3, $4, $5, now())
+		ON CONFLICT (pub_actor_url) DO UPDATE SET inbox = EXCLUDED.inbox, shared_inbox = EXCLUDED.shared_inbox,
+			key_id = EXCLUDED.key_id, public_key_pem = EXCLUDED.public_key_pem, updated_at = EXCLUDED.updated_at`,
+		actor.Id, actor.Inbox, sharedInbox, actor.PublicKey.Id, actor.PublicKey.PublicKeyPEM)
+
+	return err
+}
+
+// GetActorKey returns the actor owning the public key keyId and the key itself, as PEM, if we know of it.
+func (db *Database) GetActorKey(ctx context.Context, keyId string) (string, string, error) {
+	var actor struct {
+		ActorUrl     string `db:"pub_actor_url"`
+		PublicKeyPEM string `db:"public_key_pem"`
+	}
+	err := db.conn.GetContext(ctx, &actor, "SELECT pub_actor_url, public_key_pem FROM actors WHERE key_id = $1 AND key_id != ''", keyId)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+
+	return actor.ActorUrl, actor.PublicKeyPEM, err
+}
+
+// GetFollowerInboxes returns the inboxes a note from nostrPubkey has to be delivered to so that all its followers
+// get it, using shared inboxes where possible so that each instance only gets it once.
+func (db *Database) GetFollowerInboxes(ctx context.Context, nostrPubkey string) ([]string, error) {
+	var inboxes []string
+	if err := db.conn.SelectContext(ctx, &inboxes, `
+		SELECT DISTINCT coalesce(nullif(actors.shared_inbox, ''), actors.inbox)
+		FROM followers
+		JOIN actors ON actors.pub_actor_url = followers.pub_actor_url
+		WHERE followers.nostr_pubkey = $1
+		AND NOT EXISTS (SELECT 1 FROM actor_moves WHERE old_actor_url = followers.pub_actor_url)`,
+		nostrPubkey); err != nil {
+		return nil, err
+	}
+
+	return inboxes, nil
+}
+
+// SaveRelaySubscriber records that a fediverse relay subscribed to the public notes we bridge.
+func (db *Database) SaveRelaySubscriber(ctx context.Context, pubActorUrl string) error {
+	_, err := db.conn.ExecContext(ctx, `
+		INSERT INTO relay_subscribers (pub_actor_url) VALUES ($1)
+		ON CONFLICT (pub_actor_url) DO NOTHING`, pubActorUrl)
+
+	return err
+}
+
+func (db *Database) DeleteRelaySubscriber(ctx context.Context, pubActorUrl string) error {
+	_, err := db.conn.ExecContext(ctx, "DELETE FROM relay_subscribers WHERE pub_actor_url = $1", pubActorUrl)
+	return err
+}
+
+// GetRelayInboxes returns the inboxes of the relays subscribed to us, which public notes are forwarded to.
+func (db *Database) GetRelayInboxes(ctx context.Context) ([]string, error) {
+	var inboxes []string
+	if err := db.conn.SelectContext(ctx, &inboxes, `
+		SELECT DISTINCT coalesce(nullif(actors.shared_inbox, ''), actors.inbox)
+		FROM relay_subscribers
+		JOIN actors ON actors.pub_actor_url = relay_subscribers.pub_actor_url`); err != nil {
+		return nil, err
+	}
+
+	return inboxes, nil
+}
+
+// GetPubKeysWithFollowers returns the pubkeys followed by at least one fediverse actor we can deliver to.
+func (db *Database) GetPubKeysWithFollowers(ctx context.Context) ([]string, error) {
+	var pubkeys []string
+	if err := db.conn.SelectContext(ctx, &pubkeys, `
+		SELECT DISTINCT followers.nostr_pubkey
+		FROM followers
+		JOIN actors ON actors.pub_actor_url = followers.pub_actor_url`); err != nil {
+		return nil, err
+	}
+
+	return pubkeys, nil
+}
+
+// SaveActorMove records that an actor migrated to a new account, after which we stop delivering to the old one.
+func (db *Database) SaveActorMove(ctx context.Context, oldActorUrl string, newActorUrl string) error {
+	_, err := db.conn.ExecContext(ctx, `
+		INSERT INTO actor_moves (old_actor_url, new_actor_url)
+		VALUES ($1, $2)
+		ON CONFLICT (old_actor_url) DO UPDATE SET new_actor_url = EXCLUDED.new_actor_url, moved_at = now()`,
+		oldActorUrl, newActorUrl)
+
+	return err
+}
+
+// MarkActivityProcessed records that the activity is being handled, telling whether it is the first time we see it.
+func (db *Database) MarkActivityProcessed(ctx context.Context, activityId string) (bool, error) {
+	res, err := db.conn.ExecContext(ctx, `
+		INSERT INTO processed_activities (activity_id) VALUES ($1)
+		ON CONFLICT (activity_id) DO NOTHING`, activityId)
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := res.RowsAffected()
+	return inserted > 0, err
+}
+
+// ForgetActivity undoes MarkActivityProcessed, for activities we failed to handle and want the sender's retry of.
+func (db *Database) ForgetActivity(ctx context.Context, activityId string) error {
+	_, err := db.conn.ExecContext(ctx, "DELETE FROM processed_activities WHERE activity_id = $1", activityId)
+	return err
+}
+
+// PurgeProcessedActivities drops the ids of activities processed before the given time, by when nobody retries them.
+func (db *Database) PurgeProcessedActivities(ctx context.Context, before time.Time) error {
+	_, err := db.conn.ExecContext(ctx, "DELETE FROM processed_activities WHERE processed_at < $1", before)
+	return err
+}
+
+// SavePins replaces the pubkey's pinned notes with eventIDs, in that order.
+func (db *Database) SavePins(ctx context.Context, nostrPubkey string, eventIDs []string) error {
+	tx, err := db.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM pins WHERE nostr_pubkey = $1", nostrPubkey); err != nil {
+		return err
+	}
+
+	for i, id := range eventIDs {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO pins (nostr_pubkey, nostr_event_id, position)
+			VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING`,
+			nostrPubkey, id, i); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func (db *Database) SaveNostrKeypair(nostrPubkey string, nostrPrivkey string, pubActorUrl string) error {
-	_, err := db.conn.Exec(`
-        INSERT INTO keys (pub_actor_url, nostr_privkey, nostr_pubkey)
-        VALUES ($1, $2, $3)
-        ON CONFLICT DO NOTHING
-    `, pubActorUrl, nostrPrivkey, nostrPubkey)
+func (db *Database) GetPins(ctx context.Context, nostrPubkey string) ([]string, error) {
+	var eventIDs []string
+	if err := db.conn.SelectContext(ctx, &eventIDs, "SELECT nostr_event_id FROM pins WHERE nostr_pubkey = $1 ORDER BY position", nostrPubkey); err != nil {
+		return nil, err
+	}
+
+	return eventIDs, nil
+}
+
+// SaveRemoteFollow records a follow sent to actorUrl on behalf of a nostr user, waiting for an answer.
+func (db *Database) SaveRemoteFollow(ctx context.Context, nostrPubkey string, actorUrl string, followId string) error {
+	_, err := db.conn.ExecContext(ctx, `
+		INSERT INTO remote_follows (nostr_pubkey, actor_url, follow_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (nostr_pubkey, actor_url) DO UPDATE
+		SET follow_id = EXCLUDED.follow_id, follow_state = 'pending', updated_at = now()`,
+		nostrPubkey, actorUrl, followId)
 
 	return err
 }
+
+// GetRemoteFollows returns the fediverse actors followed on behalf of a nostr user, whatever they answered.
+func (db *Database) GetRemoteFollows(ctx context.Context, nostrPubkey string) ([]string, error) {
+	var actorUrls []string
+	if err := db.conn.SelectContext(ctx, &actorUrls, "SELECT actor_url FROM remote_follows WHERE nostr_pubkey = $1", nostrPubkey); err != nil {
+		return nil, err
+	}
+
+	return actorUrls, nil
+}
+
+// DeleteRemoteFollow forgets a follow sent on behalf of a nostr user, returning its id so that it can be undone.
+func (db *Database) DeleteRemoteFollow(ctx context.Context, nostrPubkey string, actorUrl string) (string, error) {
+	var followId string
+	err := db.conn.GetContext(ctx, &followId, `
+		DELETE FROM remote_follows WHERE nostr_pubkey = $1 AND actor_url = $2
+		RETURNING follow_id`,
+		nostrPubkey, actorUrl)
+
+	return followId, err
+}
+
+// SetRemoteFollowState records the answer actorUrl gave to the follow we sent it, telling whether it was ours.
+func (db *Database) SetRemoteFollowState(ctx context.Context, followId string, actorUrl string, state string) (bool, error) {
+	res, err := db.conn.ExecContext(ctx, `
+		UPDATE remote_follows SET follow_state = $3, updated_at = now()
+		WHERE follow_id = $1 AND actor_url = $2`,
+		followId, actorUrl, state)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := res.RowsAffected()
+	return updated > 0, err
+}
+
+// SaveAliases replaces the accounts the pubkey declares to also be.
+func (db *Database) SaveAliases(ctx context.Context, nostrPubkey string, aliases []string) error {
+	tx, err := db.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM actor_aliases WHERE nostr_pubkey = $1", nostrPubkey); err != nil {
+		return err
+	}
+
+	for _, alias := range aliases {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO actor_aliases (nostr_pubkey, alias)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING`,
+			nostrPubkey, alias); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *Database) GetAliases(ctx context.Context, nostrPubkey string) ([]string, error) {
+	var aliases []string
+	if err := db.conn.SelectContext(ctx, &aliases, "SELECT alias FROM actor_aliases WHERE nostr_pubkey = $1 ORDER BY created_at, alias", nostrPubkey); err != nil {
+		return nil, err
+	}
+
+	return aliases, nil
+}
+
+func (db *Database) GetBlocklist(ctx context.Context) ([]BlocklistEntry, error) {
+	var entries []BlocklistEntry
+	if err := db.conn.SelectContext(ctx, &entries, "SELECT kind, value FROM blocklist"); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (db *Database) GetAllowlist(ctx context.Context) ([]string, error) {
+	var domains []string
+	if err := db.conn.SelectContext(ctx, &domains, "SELECT domain FROM allowlist"); err != nil {
+		return nil, err
+	}
+
+	return domains, nil
+}
+
+func (db *Database) Ping(ctx context.Context) error {
+	return db.conn.PingContext(ctx)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// testDatabase connects to the database in TEST_DATABASE_URL and brings it up to date, the tests that need one
+// are skipped without it. Each test gets a schema of its own, dropped once it's done.
+func testDatabase(t *testing.T) *sqlx.DB {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	conn, err := sqlx.Connect("postgres", url)
+	if err != nil {
+		t.Fatalf("couldn't connect to the test database: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// one connection, so that the search_path set below holds for every query
+	conn.SetMaxOpenConns(1)
+	for _, statement := range []string{
+		"DROP SCHEMA IF EXISTS nofed_test CASCADE",
+		"CREATE SCHEMA nofed_test",
+		"SET search_path TO nofed_test",
+	} {
+		if _, err := conn.Exec(statement); err != nil {
+			t.Fatalf("couldn't set up the test schema: %v", err)
+		}
+	}
+	t.Cleanup(func() { conn.Exec("DROP SCHEMA IF EXISTS nofed_test CASCADE") })
+
+	if err := NewDatabase(conn).Setup(context.Background()); err != nil {
+		t.Fatalf("couldn't migrate the test database: %v", err)
+	}
+
+	return conn
+}
+
+func TestFollowersAreTheActorsThatFollowed(t *testing.T) {
+	ctx := context.Background()
+	db := NewDatabase(testDatabase(t))
+
+	pubkey := "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	follower := "https://mastodon.example/users/alice"
+	if err := db.FollowNostrPubKey(ctx, follower, pubkey); err != nil {
+		t.Fatalf("FollowNostrPubKey: %v", err)
+	}
+
+	followers, err := db.GetFollowersByPubKey(ctx, pubkey, 10, 0)
+	if err != nil {
+		t.Fatalf("GetFollowersByPubKey: %v", err)
+	}
+	if len(followers) != 1 || followers[0] != follower {
+		t.Errorf("got followers %v, want [%s]", followers, follower)
+	}
+}
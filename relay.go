@@ -1,21 +1,34 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"runtime"
+	"sort"
+	"time"
 
-	"github.com/fiatjaf/litepub"
 	"github.com/fiatjaf/relayer"
 	"github.com/nbd-wtf/go-nostr"
 	"golang.org/x/exp/slices"
 )
 
 type Relay struct {
-	storage Storage
+	storage     Storage
+	events      chan nostr.Event
+	policy      *FederationPolicy
+	initialized chan struct{}
+	done        <-chan struct{}
 }
 
-func NewRelay(storage Storage) Relay {
+// NewRelay creates the relay, anything sent to events is broadcast to the clients subscribed to it. It's
+// done once done is closed.
+func NewRelay(storage Storage, events chan nostr.Event, policy *FederationPolicy, done <-chan struct{}) Relay {
 	return Relay{
-		storage: storage,
+		storage:     storage,
+		events:      events,
+		policy:      policy,
+		initialized: make(chan struct{}),
+		done:        done,
 	}
 }
 
@@ -27,7 +40,19 @@ func (r Relay) Storage() relayer.Storage {
 	return r.storage
 }
 
-func (r Relay) OnInitialized() {}
+// OnInitialized is called by relayer.Start once its routes are set up, right before it listens with a server of
+// its own that can't be shut down. relayer (as of v1.5.2) has no other way to get its websocket handler, so we
+// serve relayer.Router with our own server instead and keep Start here until we're done, then end its goroutine
+// so that it never gets to listen.
+func (r Relay) OnInitialized() {
+	close(r.initialized)
+	<-r.done
+	runtime.Goexit()
+}
+
+func (r Relay) InjectEvents() chan nostr.Event {
+	return r.events
+}
 
 func (r Relay) Init() error {
 	filters := relayer.GetListeningFilters()
@@ -45,21 +70,33 @@ func (r Relay) AcceptEvent(evt *nostr.Event) bool {
 		return false
 	}
 
+	if r.policy.BlocksPubKey(evt.PubKey) {
+		return false
+	}
+
+	if isExpired(*evt) {
+		return false
+	}
+
 	return true
 }
 
 type Storage struct {
 	db          StorageProvider
 	activitypub ActivityPubProvider
+	nostr       NostrProvider
+	fetcher     FetchProvider
 }
 
-func NewStorage(db StorageProvider, activitypub ActivityPubProvider) Storage {
+func NewStorage(db StorageProvider, activitypub ActivityPubProvider, nostr NostrProvider, fetcher FetchProvider) Storage {
 	//CODEREVIEW: activitypub should never have to be injected into storage, as they should have no direct interaction
 	//with each other. Ideally we would inject an ActivityPubProvider into the Relay, which would implement QueryEvents,
 	//but the external dependency requires that Storage implement QueryEvents.
 	return Storage{
 		db,
 		activitypub,
+		nostr,
+		fetcher,
 	}
 }
 
@@ -67,55 +104,74 @@ func (s Storage) Init() error {
 	return nil
 }
 
+// SaveEvent doesn't store anything, ephemeral events or not, but notes posted to us by their authors' clients go
+// out to their fediverse followers as the notes we see through subscriptions do.
 func (s Storage) SaveEvent(evt *nostr.Event) error {
-	// we don't store anything
+	if evt.Kind != 1 {
+		return nil
+	}
+
+	event := *evt
+	tasks.Go(func() {
+		s.nostr.DeliverEvent(context.Background(), event)
+	})
 	return nil
 }
 
 func (s Storage) QueryEvents(filter *nostr.Filter) (events []nostr.Event, err error) {
+	// relayer doesn't hand us the subscription's context, so each query gets its own trace
+	ctx, span := tracer.Start(context.Background(), "Storage.QueryEvents")
+	defer span.End()
+
 	// search activitypub servers for these specific notes
 	if len(filter.IDs) > 0 {
 		for _, id := range filter.IDs {
-			noteUrl, err := s.db.GetNoteURLByEventID(id)
+			noteUrl, err := s.db.GetNoteURLByEventID(ctx, id)
 			if err != nil {
 				continue
 			}
 
-			note, err := litepub.FetchNote(noteUrl)
+			note, err := s.fetcher.FetchNote(noteUrl)
 			if err != nil {
 				continue
 			}
-			event, _ := s.activitypub.NoteToEvent(note)
+			event, _ := s.activitypub.NoteToEvent(ctx, note)
 			events = append(events, *event)
 		}
 
-		return events, nil
+		return newestEvents(eventsInWindow(events, filter), filter.Limit), nil
 	}
 
-	// search activitypub servers for stuff from these authors
+	// search activitypub servers for stuff from these authors, the ones that aren't bridged from the fediverse
+	// are left for the nostr relays
+	var nostrAuthors []string
 	for _, pubkey := range filter.Authors {
-		actorUrl, err := s.db.GetActorURLByPubKey(pubkey)
-		if err != nil {
+		actorUrl, err := s.db.GetActorURLByPubKey(ctx, pubkey)
+		if err != nil || actorUrl == "" {
+			nostrAuthors = append(nostrAuthors, pubkey)
 			continue
 		}
 
-		actor, err := litepub.FetchActor(actorUrl)
+		actor, err := s.fetcher.FetchActor(actorUrl)
 		if err != nil {
 			continue
 		}
 
 		if slices.Contains(filter.Kinds, 0) {
 			// return actor metadata
-			event, _ := s.activitypub.ActorToEvent(actor)
+			event, _ := s.activitypub.ActorToEvent(ctx, actor)
 			events = append(events, *event)
 		}
 
 		if slices.Contains(filter.Kinds, 1) {
 			// return actor notes
-			notes, err := litepub.FetchNotes(actor.Outbox)
+			notes, err := s.fetcher.FetchNotes(actor.Outbox, filter.Since)
 			if err == nil {
 				for _, note := range notes {
-					event, _ := s.activitypub.NoteToEvent(&note)
+					if !inWindow(note.Published, filter) {
+						continue
+					}
+					event, _ := s.activitypub.NoteToEvent(ctx, &note)
 					events = append(events, *event)
 				}
 			}
@@ -123,25 +179,78 @@ func (s Storage) QueryEvents(filter *nostr.Filter) (events []nostr.Event, err er
 
 		if slices.Contains(filter.Kinds, 3) {
 			// return actor follows
-			event, _ := s.activitypub.ActorFollowsToEvent(actor)
+			event, _ := s.activitypub.ActorFollowsToEvent(ctx, actor)
 			events = append(events, *event)
 		}
+
+		if slices.Contains(filter.Kinds, 10001) {
+			// return actor pinned notes
+			if event, err := s.activitypub.ActorPinsToEvent(ctx, actor); err == nil {
+				events = append(events, *event)
+			}
+		}
+	}
+
+	// ask the relays about all the other authors at once rather than one query each
+	if len(nostrAuthors) > 0 {
+		byPubKey := s.nostr.GetEventsByPubKeys(ctx, nostrAuthors, filter.Kinds)
+		for _, pubkey := range nostrAuthors {
+			events = append(events, byPubKey[pubkey]...)
+		}
 	}
 
 	// search activity pub for replies to a note
 	for _, id := range filter.Tags["e"] {
-		noteUrl, err := s.db.GetNoteURLByEventID(id)
+		// whole threads we've already bridged can be served from the database
+		if thread, err := s.db.GetThreadByRootID(ctx, id); err == nil && len(thread) > 0 {
+			events = append(events, thread...)
+			continue
+		}
+
+		noteUrl, err := s.db.GetNoteURLByEventID(ctx, id)
 		if err != nil {
 			continue
 		}
 
-		if note, err := litepub.FetchNote(noteUrl); err == nil {
-			event, _ := s.activitypub.NoteToEvent(note)
+		if note, err := s.fetcher.FetchNote(noteUrl); err == nil {
+			event, _ := s.activitypub.NoteToEvent(ctx, note)
 			events = append(events, *event)
 		}
 	}
 
-	return nil, nil
+	return newestEvents(eventsInWindow(events, filter), filter.Limit), nil
+}
+
+// inWindow tells whether t is within the filter's since and until, both inclusive as relays have them.
+func inWindow(t time.Time, filter *nostr.Filter) bool {
+	return (filter.Since == nil || !t.Before(*filter.Since)) && (filter.Until == nil || !t.After(*filter.Until))
+}
+
+func eventsInWindow(events []nostr.Event, filter *nostr.Filter) []nostr.Event {
+	if filter.Since == nil && filter.Until == nil {
+		return events
+	}
+
+	kept := events[:0]
+	for _, event := range events {
+		if inWindow(event.CreatedAt, filter) {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
+
+// newestEvents sorts events from newest to oldest, the order relays answer in, and keeps the first limit of them
+// if there's a limit.
+func newestEvents(events []nostr.Event, limit int) []nostr.Event {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].CreatedAt.After(events[j].CreatedAt)
+	})
+
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return events
 }
 
 func (s Storage) DeleteEvent(id string, pubkey string) error {
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// relayIdleTimeout is how long a connection nobody used is kept open.
+	relayIdleTimeout = 10 * time.Minute
+	// relayMaxBackoff caps how long a failing relay is left alone for.
+	relayMaxBackoff = 10 * time.Minute
+)
+
+// relayPool keeps connections to relays open so they can be reused across queries and subscriptions, and
+// backs off exponentially from relays that fail, so that they aren't hammered with reconnection attempts.
+type relayPool struct {
+	mu     sync.Mutex
+	conns  map[string]*pooledRelay
+	health map[string]*relayHealth
+}
+
+type pooledRelay struct {
+	relay    *nostr.Relay
+	done     chan struct{}
+	lastUsed time.Time
+}
+
+type relayHealth struct {
+	failures int
+	retryAt  time.Time
+	lastSeen time.Time
+}
+
+func newRelayPool() *relayPool {
+	return &relayPool{
+		conns:  make(map[string]*pooledRelay),
+		health: make(map[string]*relayHealth),
+	}
+}
+
+// Get returns an open connection to relayUrl, connecting if needed. The returned channel is closed once the
+// connection drops. Relays that failed recently are refused until their backoff is over.
+func (p *relayPool) Get(ctx context.Context, relayUrl string) (*nostr.Relay, <-chan struct{}, error) {
+	p.mu.Lock()
+	p.evictIdle()
+	if conn, ok := p.conns[relayUrl]; ok {
+		conn.lastUsed = time.Now()
+		p.mu.Unlock()
+		return conn.relay, conn.done, nil
+	}
+
+	if health, ok := p.health[relayUrl]; ok && time.Now().Before(health.retryAt) {
+		p.mu.Unlock()
+		return nil, nil, fmt.Errorf("backing off from %s until %s", relayUrl, health.retryAt.Format(time.RFC3339))
+	}
+	p.mu.Unlock()
+
+	relay, err := nostr.RelayConnect(ctx, relayUrl)
+	if err != nil {
+		p.failed(relayUrl)
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// someone else may have connected in the meantime
+	if conn, ok := p.conns[relayUrl]; ok {
+		_ = relay.Close()
+		conn.lastUsed = time.Now()
+		return conn.relay, conn.done, nil
+	}
+
+	conn := &pooledRelay{relay, make(chan struct{}), time.Now()}
+	p.conns[relayUrl] = conn
+	p.healthOf(relayUrl).failures = 0
+	p.healthOf(relayUrl).lastSeen = time.Now()
+	go p.watch(relayUrl, conn)
+
+	return conn.relay, conn.done, nil
+}
+
+// Seen records that relayUrl answered us.
+func (p *relayPool) Seen(relayUrl string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.healthOf(relayUrl).lastSeen = time.Now()
+}
+
+// Reachable counts the relays that answered within the given window.
+func (p *relayPool) Reachable(window time.Duration) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	count := 0
+	for _, health := range p.health {
+		if time.Since(health.lastSeen) < window {
+			count++
+		}
+	}
+	return count
+}
+
+// watch drains the connection's notices and drops it from the pool once it fails.
+func (p *relayPool) watch(relayUrl string, conn *pooledRelay) {
+	for {
+		select {
+		case notice := <-conn.relay.Notices:
+			log.Debug().Str("relay", relayUrl).Str("notice", notice).Msg("relay notice")
+		case err := <-conn.relay.ConnectionError:
+			log.Debug().Err(err).Str("relay", relayUrl).Msg("relay connection dropped")
+
+			p.mu.Lock()
+			if p.conns[relayUrl] == conn {
+				delete(p.conns, relayUrl)
+			}
+			p.mu.Unlock()
+
+			close(conn.done)
+			return
+		}
+	}
+}
+
+func (p *relayPool) failed(relayUrl string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	health := p.healthOf(relayUrl)
+	health.failures++
+	health.lastSeen = time.Time{}
+
+	backoff := time.Second << (health.failures - 1)
+	if backoff > relayMaxBackoff || backoff <= 0 {
+		backoff = relayMaxBackoff
+	}
+	health.retryAt = time.Now().Add(backoff)
+}
+
+// evictIdle closes connections that haven't been used for a while, it must be called with the lock held.
+func (p *relayPool) evictIdle() {
+	for relayUrl, conn := range p.conns {
+		if time.Since(conn.lastUsed) > relayIdleTimeout {
+			delete(p.conns, relayUrl)
+			_ = conn.relay.Close()
+		}
+	}
+}
+
+func (p *relayPool) healthOf(relayUrl string) *relayHealth {
+	health, ok := p.health[relayUrl]
+	if !ok {
+		health = &relayHealth{}
+		p.health[relayUrl] = health
+	}
+	return health
+}
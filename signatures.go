@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// signRequest attaches an HTTP Signature (draft-cavage, rsa-sha256 or hs2019 for Ed25519 keys) to an outgoing request.
+// When body is not nil a Digest header is added and covered by the signature as well.
+func signRequest(r *http.Request, privateKey crypto.Signer, keyId string, body []byte) error {
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	r.Header.Set("Host", r.URL.Host)
+
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		digest := sha256.Sum256(body)
+		r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+		headers = append(headers, "digest")
+	}
+
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines[i] = fmt.Sprintf("(request-target): %s %s", strings.ToLower(r.Method), r.URL.RequestURI())
+		case "host":
+			lines[i] = "host: " + r.URL.Host
+		default:
+			lines[i] = h + ": " + r.Header.Get(h)
+		}
+	}
+
+	var signature []byte
+	var algorithm string
+	switch key := privateKey.(type) {
+	case ed25519.PrivateKey:
+		// Ed25519 signs the message itself, and has no algorithm name of its own in the draft
+		signature = ed25519.Sign(key, []byte(strings.Join(lines, "\n")))
+		algorithm = "hs2019"
+	case *rsa.PrivateKey:
+		hashed := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:]); err != nil {
+			return err
+		}
+		algorithm = "rsa-sha256"
+	default:
+		return fmt.Errorf("unsupported signing key %T", privateKey)
+	}
+
+	r.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s",algorithm="%s",headers="%s",signature="%s"`,
+		keyId, algorithm, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+
+	return nil
+}
+
+// signatureParams is what the Signature header of an incoming request is made of.
+type signatureParams struct {
+	keyId     string
+	algorithm string
+	headers   []string
+	signature []byte
+}
+
+// parseSignature reads a draft-cavage Signature header, whose values are quoted and may well contain "=" or ",".
+func parseSignature(header string) (*signatureParams, error) {
+	params := &signatureParams{headers: []string{"date"}}
+	for rest := strings.TrimSpace(header); rest != ""; {
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok || !strings.HasPrefix(value, `"`) {
+			return nil, fmt.Errorf("malformed signature header %q", header)
+		}
+		end := strings.Index(value[1:], `"`)
+		if end < 0 {
+			return nil, fmt.Errorf("malformed signature header %q", header)
+		}
+		value, rest = value[1:end+1], strings.TrimLeft(value[end+2:], ", ")
+
+		switch strings.TrimSpace(name) {
+		case "keyId":
+			params.keyId = value
+		case "algorithm":
+			params.algorithm = value
+		case "headers":
+			params.headers = strings.Fields(strings.ToLower(value))
+		case "signature":
+			signature, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid signature: %w", err)
+			}
+			params.signature = signature
+		}
+	}
+
+	if params.keyId == "" || len(params.signature) == 0 {
+		return nil, fmt.Errorf("signature header %q lacks a keyId or a signature", header)
+	}
+	return params, nil
+}
+
+// signingString rebuilds what the sender signed out of the headers its signature covers.
+func signingString(r *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines[i] = fmt.Sprintf("(request-target): %s %s", strings.ToLower(r.Method), r.URL.RequestURI())
+		case "host":
+			lines[i] = "host: " + r.Host
+		default:
+			lines[i] = h + ": " + strings.Join(r.Header.Values(h), ", ")
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// verifySignature checks a signature over message with a PEM encoded RSA or Ed25519 public key. hs2019 doesn't
+// name the algorithm, which is then the one of the key.
+func verifySignature(publicKeyPEM string, algorithm string, message string, signature []byte) error {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return fmt.Errorf("invalid public key")
+	}
+
+	var key crypto.PublicKey
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		if key, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+			return fmt.Errorf("invalid public key: %w", err)
+		}
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm != "" && algorithm != "rsa-sha256" && algorithm != "hs2019" {
+			return fmt.Errorf("unsupported algorithm %s for an RSA key", algorithm)
+		}
+		hashed := sha256.Sum256([]byte(message))
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature)
+	case ed25519.PublicKey:
+		if algorithm != "" && algorithm != "ed25519" && algorithm != "hs2019" {
+			return fmt.Errorf("unsupported algorithm %s for an Ed25519 key", algorithm)
+		}
+		if !ed25519.Verify(key, []byte(message), signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key %T", key)
+	}
+}
+
+// verifyDigest checks the Digest header of an incoming request against its body, so that a signed set of headers
+// can't be sent along with another body.
+func verifyDigest(header string, body []byte) error {
+	if header == "" {
+		return fmt.Errorf("missing digest")
+	}
+
+	supported := false
+	for _, entry := range strings.Split(header, ",") {
+		algorithm, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+
+		var sum []byte
+		switch strings.ToUpper(algorithm) {
+		case "SHA-256":
+			digest := sha256.Sum256(body)
+			sum = digest[:]
+		case "SHA-512":
+			digest := sha512.Sum512(body)
+			sum = digest[:]
+		default:
+			continue
+		}
+
+		supported = true
+		if value != base64.StdEncoding.EncodeToString(sum) {
+			return fmt.Errorf("%s digest doesn't match the body", algorithm)
+		}
+	}
+
+	if !supported {
+		return fmt.Errorf("no supported digest algorithm in %q", header)
+	}
+	return nil
+}
+
+// checkDate makes sure the Date header of an incoming request is within skew of now, so that a captured request
+// can't be replayed later on. Replays within the window are caught by the activity ids we already processed.
+func checkDate(header string, skew time.Duration) error {
+	if header == "" {
+		return fmt.Errorf("missing date")
+	}
+
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return fmt.Errorf("invalid date %q: %w", header, err)
+	}
+
+	if offset := time.Since(date); offset > skew || offset < -skew {
+		return fmt.Errorf("date %s is %s off", header, offset.Round(time.Second))
+	}
+	return nil
+}
+
+// sameHost tells whether both URLs are on the same host, as an actor and its key must be.
+func sameHost(a string, b string) bool {
+	parsedA, err := url.Parse(a)
+	if err != nil || parsedA.Host == "" {
+		return false
+	}
+	parsedB, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(parsedA.Host, parsedB.Host)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// resubscribeInterval is how often subscriptions are renewed to pick up pubkeys that gained followers.
+const resubscribeInterval = 5 * time.Minute
+
+// SubscribeForDelivery keeps subscriptions open on a few relays for notes from the pubkeys followed from the
+// fediverse and queues each new one for delivery to their followers' inboxes. Their new contact lists are handed
+// to onContactList. It returns once ctx is cancelled.
+func (n *NostrService) SubscribeForDelivery(ctx context.Context, onContactList func(context.Context, nostr.Event)) {
+	var wg sync.WaitGroup
+	for _, i := range rand.Perm(len(n.peers))[:n.settings.QueryRelayCount] {
+		relayUrl := n.peers[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.subscribeRelay(ctx, relayUrl, n.delivered, onContactList)
+		}()
+	}
+	wg.Wait()
+}
+
+// subscribeRelay subscribes to one relay, reconnecting whenever the connection drops.
+func (n *NostrService) subscribeRelay(ctx context.Context, relayUrl string, seen *seenEvents, onContactList func(context.Context, nostr.Event)) {
+	since := time.Now()
+
+	for ctx.Err() == nil {
+		pubkeys, err := n.db.GetPubKeysWithFollowers(ctx)
+		if err != nil || len(pubkeys) == 0 {
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to get pubkeys with followers")
+			}
+			sleep(ctx, resubscribeInterval)
+			continue
+		}
+
+		// the pool takes care of backing off from relays that keep failing
+		connectContext, cancel := context.WithTimeout(ctx, n.settings.RelayQueryTimeout)
+		relay, done, err := n.pool.Get(connectContext, relayUrl)
+		cancel()
+		if err != nil {
+			log.Debug().Err(err).Str("relay", relayUrl).Msg("failed to connect for subscription")
+			sleep(ctx, time.Second)
+			continue
+		}
+
+		since = n.listen(ctx, relay, done, nostr.Filter{
+			Kinds:   []int{1, 3, 5},
+			Authors: pubkeys,
+			Since:   &since,
+		}, seen, onContactList)
+	}
+}
+
+// listen delivers the events coming through a subscription until the connection drops, ctx is cancelled or
+// it is time to resubscribe. It returns the timestamp to resubscribe from so that nothing is missed in between.
+func (n *NostrService) listen(ctx context.Context, relay *nostr.Relay, done <-chan struct{}, filter nostr.Filter, seen *seenEvents, onContactList func(context.Context, nostr.Event)) time.Time {
+	since := *filter.Since
+
+	subContext, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub := relay.Subscribe(subContext, nostr.Filters{filter})
+
+	renew := time.NewTimer(resubscribeInterval)
+	defer renew.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				return since
+			}
+			n.pool.Seen(relay.URL)
+			if event.CreatedAt.After(since) {
+				since = event.CreatedAt
+			}
+			if !seen.Add(event.ID) || isExpired(event) {
+				continue
+			}
+			switch event.Kind {
+			case 1:
+				n.deliverEvent(ctx, event)
+			case 3:
+				onContactList(ctx, event)
+			case 5:
+				n.recordDeletion(ctx, event)
+			}
+		case <-sub.EndOfStoredEvents:
+		case <-done:
+			return since
+		case <-renew.C:
+			return since
+		case <-ctx.Done():
+			return since
+		}
+	}
+}
+
+// DeliverEvent queues a note posted straight to our relay for delivery, unless a subscription already got it.
+func (n *NostrService) DeliverEvent(ctx context.Context, event nostr.Event) {
+	if n.delivered.Add(event.ID) {
+		n.deliverEvent(ctx, event)
+	}
+}
+
+// deliverEvent queues a new note for delivery to every inbox following its author, and to the relays subscribed
+// to us for them to spread it further.
+func (n *NostrService) deliverEvent(ctx context.Context, event nostr.Event) {
+	inboxes, err := n.db.GetFollowerInboxes(ctx, event.PubKey)
+	if err != nil {
+		log.Warn().Err(err).Str("pubkey", event.PubKey).Msg("failed to get follower inboxes")
+		return
+	}
+	if n.settings.AcceptRelays {
+		relayInboxes, err := n.db.GetRelayInboxes(ctx)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to get relay inboxes")
+		}
+		for _, inbox := range relayInboxes {
+			if !slices.Contains(inboxes, inbox) {
+				inboxes = append(inboxes, inbox)
+			}
+		}
+	}
+	if len(inboxes) == 0 {
+		return
+	}
+
+	create := wrapCreate(n.EventToNote(event), fmt.Sprintf("%s/pub/create/%s", n.settings.ServiceURL, event.ID))
+	body, err := json.Marshal(create)
+	if err != nil {
+		log.Warn().Err(err).Str("id", event.ID).Msg("failed to marshal create activity")
+		return
+	}
+
+	keyId := fmt.Sprintf("%s/pub/user/%s#main-key", n.settings.ServiceURL, event.PubKey)
+	if n.settings.LDSignatures {
+		// without one the note still goes out, just not verifiable once forwarded
+		if signed, err := ldSign(body, n.settings.PrivateKey, keyId); err == nil {
+			body = signed
+		} else {
+			log.Warn().Err(err).Str("id", event.ID).Msg("failed to add LD signature")
+		}
+	}
+
+	for _, inbox := range inboxes {
+		if err := n.db.EnqueueDelivery(ctx, inbox, keyId, body); err != nil {
+			log.Warn().Err(err).Str("inbox", inbox).Msg("failed to queue delivery")
+		}
+	}
+
+	log.Debug().Str("id", event.ID).Int("inboxes", len(inboxes)).Msg("queued note for delivery")
+}
+
+// recordDeletion records the notes a NIP-09 deletion asks to delete, as long as they are from its author.
+func (n *NostrService) recordDeletion(ctx context.Context, deletion nostr.Event) {
+	for _, tag := range deletion.Tags.GetAll([]string{"e"}) {
+		event, err := n.GetEventByID(ctx, tag.Value())
+		if err != nil || event.PubKey != deletion.PubKey {
+			continue
+		}
+
+		if err := n.db.SaveNoteDeletion(ctx, event.ID); err != nil {
+			log.Warn().Err(err).Str("id", event.ID).Msg("failed to record note deletion")
+			continue
+		}
+		if err := n.cache.ClearCacheByKey(noteKey(event.ID)); err != nil {
+			log.Warn().Err(err).Str("id", event.ID).Msg("failed to clear deleted note")
+		}
+	}
+}
+
+// seenEvents remembers the ids of the latest events delivered, as the same note comes from several relays.
+type seenEvents struct {
+	mu    sync.Mutex
+	ids   map[string]bool
+	order []string
+}
+
+// Add records id and tells whether it is new.
+func (s *seenEvents) Add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ids[id] {
+		return false
+	}
+
+	s.ids[id] = true
+	s.order = append(s.order, id)
+	if len(s.order) > 10000 {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+
+	return true
+}
+
+// sleep waits for d or until ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// BackgroundTasks keeps track of fire-and-forget goroutines (cache writes, deliveries)
+// so that shutdown can wait for them to finish instead of killing them mid-flight.
+type BackgroundTasks struct {
+	wg sync.WaitGroup
+}
+
+var tasks BackgroundTasks
+
+func (t *BackgroundTasks) Go(fn func()) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		fn()
+	}()
+}
+
+// Wait blocks until all tasks are done or the timeout elapses, returning false in the latter case.
+func (t *BackgroundTasks) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/fiatjaf/litepub"
+	"html"
+	"strings"
+	"time"
+)
+
+// CollectionPage is litepub.OrderedCollectionPage with optional next/prev links,
+// which must be left out entirely rather than sent empty on the first and last pages.
+type CollectionPage[I any] struct {
+	litepub.Base
+
+	TotalItems   int    `json:"totalItems"`
+	PartOf       string `json:"partOf"`
+	OrderedItems []I    `json:"orderedItems"`
+	Next         string `json:"next,omitempty"`
+	Prev         string `json:"prev,omitempty"`
+}
+
+// Actor is litepub.Actor plus the fields we need that it doesn't have.
+type Actor struct {
+	litepub.Actor
+
+	// Context takes the place of litepub's, which doesn't define the Multikey terms
+	Context actorContext `json:"@context"`
+
+	// Featured is the collection of the actor's pinned notes
+	Featured    string          `json:"featured,omitempty"`
+	Endpoints   *ActorEndpoints `json:"endpoints,omitempty"`
+	AlsoKnownAs []string        `json:"alsoKnownAs,omitempty"`
+
+	AssertionMethod []Multikey `json:"assertionMethod,omitempty"`
+}
+
+// actorContext is the @context of actors: litepub's, plus the one defining Multikey and publicKeyMultibase.
+type actorContext struct{}
+
+func (c *actorContext) UnmarshalJSON([]byte) error {
+	return nil
+}
+
+func (c actorContext) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]string{
+		"https://www.w3.org/ns/activitystreams",
+		"https://w3id.org/security/v1",
+		"https://w3id.org/security/multikey/v1",
+		"https://pleroma.site/schemas/litepub-0.1.jsonld",
+	})
+}
+
+// Multikey is a public key as described by FEP-521a.
+type Multikey struct {
+	Id                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+// multikeys lists the Multikey of one of our actors, if its key has a Multikey form.
+func multikeys(actorUrl string, publicKeyMultibase string) []Multikey {
+	if publicKeyMultibase == "" {
+		return nil
+	}
+
+	return []Multikey{{
+		Id:                 actorUrl + "#ed25519-key",
+		Type:               "Multikey",
+		Controller:         actorUrl,
+		PublicKeyMultibase: publicKeyMultibase,
+	}}
+}
+
+type ActorEndpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+// DeliveryInbox is where activities for this actor should be POSTed, preferring the shared inbox of its instance.
+func (a *Actor) DeliveryInbox() string {
+	if a.Endpoints != nil && a.Endpoints.SharedInbox != "" {
+		return a.Endpoints.SharedInbox
+	}
+
+	return a.Inbox
+}
+
+// Note is litepub.Note plus the fields we need that it doesn't have.
+type Note struct {
+	litepub.Note
+
+	// Name is the title of articles, notes don't have one
+	Name string `json:"name,omitempty"`
+
+	// Summary is the subject of the note or, when it is sensitive, its content warning
+	Summary   string `json:"summary,omitempty"`
+	Sensitive bool   `json:"sensitive,omitempty"`
+
+	// ContentMap holds the content keyed by language, usually just the one it was written in
+	ContentMap map[string]string `json:"contentMap,omitempty"`
+
+	Tag []NoteTag `json:"tag,omitempty"`
+
+	// OneOf and AnyOf are the options of a Question, a poll, depending on whether voters pick one or several
+	OneOf []QuestionOption `json:"oneOf,omitempty"`
+	AnyOf []QuestionOption `json:"anyOf,omitempty"`
+
+	Attachment []Attachment `json:"attachment,omitempty"`
+}
+
+// Attachment is a picture, video or sound attached to a note, Name being its description.
+type Attachment struct {
+	Type      string   `json:"type"`
+	MediaType string   `json:"mediaType,omitempty"`
+	URL       mediaURL `json:"url"`
+	Name      string   `json:"name,omitempty"`
+}
+
+// Media is an Image, Video or Audio posted on its own rather than attached to a Note, as Pixelfed and
+// PeerTube do.
+type Media struct {
+	Note
+
+	MediaType string   `json:"mediaType,omitempty"`
+	URL       mediaURL `json:"url"`
+}
+
+// asNote turns the media into a note with the media as attachment and its title and description as content.
+func (m *Media) asNote() *Note {
+	note := m.Note
+	note.Type = "Note"
+	if note.Name != "" {
+		note.Content = "<p>" + html.EscapeString(note.Name) + "</p>" + note.Content
+		note.Name = ""
+	}
+	if m.URL != "" {
+		note.Attachment = append([]Attachment{{Type: m.Type, MediaType: m.MediaType, URL: m.URL}}, note.Attachment...)
+	}
+
+	return &note
+}
+
+// mediaURL is the "url" of media, which can be a plain URL, a Link or a list of them, in which case the
+// first link to the media itself is picked, falling back to the first link at all.
+type mediaURL string
+
+func (u *mediaURL) UnmarshalJSON(data []byte) error {
+	var plain string
+	if err := json.Unmarshal(data, &plain); err == nil {
+		*u = mediaURL(plain)
+		return nil
+	}
+
+	var links []mediaLink
+	if err := json.Unmarshal(data, &links); err != nil {
+		var link mediaLink
+		if err := json.Unmarshal(data, &link); err != nil {
+			return err
+		}
+		links = []mediaLink{link}
+	}
+
+	*u = ""
+	for _, link := range links {
+		if *u == "" {
+			*u = mediaURL(link.Href)
+		}
+		kind, _, _ := strings.Cut(link.MediaType, "/")
+		if kind == "image" || kind == "video" || kind == "audio" {
+			*u = mediaURL(link.Href)
+			break
+		}
+	}
+	return nil
+}
+
+type mediaLink struct {
+	Href      string `json:"href"`
+	MediaType string `json:"mediaType"`
+}
+
+type QuestionOption struct {
+	Name string `json:"name"`
+}
+
+// isNoteType tells whether objects of the given type can be bridged as notes, polls being notes with options.
+func isNoteType(objectType string) bool {
+	return objectType == "Note" || objectType == "Question"
+}
+
+// NoteTag is an entry of a note's "tag" array, we only care about custom emoji ones for now.
+type NoteTag struct {
+	Type string        `json:"type"`
+	Name string        `json:"name,omitempty"`
+	Href string        `json:"href,omitempty"`
+	Icon *NoteTagImage `json:"icon,omitempty"`
+}
+
+type NoteTagImage struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType,omitempty"`
+	URL       string `json:"url"`
+}
+
+// EmojiReact is a reaction to a note with a specific emoji, as Pleroma and Akkoma send them. Content is the
+// emoji itself or, for custom ones, their ":shortcode:", described in Tag.
+type EmojiReact struct {
+	litepub.Base
+
+	Actor   string          `json:"actor"`
+	Object  json.RawMessage `json:"object"`
+	Content string          `json:"content"`
+	Tag     []NoteTag       `json:"tag,omitempty"`
+}
+
+// Tombstone stands in for a deleted object.
+type Tombstone struct {
+	litepub.Base
+
+	FormerType string    `json:"formerType"`
+	Deleted    time.Time `json:"deleted"`
+}
+
+// wrapCreate is litepub.WrapCreate for our Note type.
+func wrapCreate(note Note, createId string) litepub.Create[Note] {
+	return litepub.Create[Note]{
+		Base: litepub.Base{
+			Type: "Create",
+			Id:   createId,
+		},
+		Actor:  note.AttributedTo,
+		Object: note,
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/fiatjaf/litepub"
+	"golang.org/x/exp/slices"
+)
+
+func TestActorContextDefinesMultikey(t *testing.T) {
+	actor := Actor{
+		Actor:           litepub.Actor{Base: litepub.Base{Id: "https://bridge.example/pub/user/abc", Type: "Person"}},
+		AssertionMethod: multikeys("https://bridge.example/pub/user/abc", "z6Mk"),
+	}
+
+	encoded, err := json.Marshal(actor)
+	if err != nil {
+		t.Fatalf("couldn't encode actor: %v", err)
+	}
+
+	var document struct {
+		Context []string `json:"@context"`
+	}
+	if err := json.Unmarshal(encoded, &document); err != nil {
+		t.Fatalf("@context isn't a list of strings: %v", err)
+	}
+	for _, context := range []string{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1", "https://w3id.org/security/multikey/v1"} {
+		if !slices.Contains(document.Context, context) {
+			t.Errorf("@context %v doesn't have %s", document.Context, context)
+		}
+	}
+}
+
+func TestActorDecodesAnyContext(t *testing.T) {
+	for _, document := range []string{
+		`{"@context": "https://www.w3.org/ns/activitystreams", "id": "https://m.example/users/a"}`,
+		`{"@context": ["https://www.w3.org/ns/activitystreams", {"toot": "http://joinmastodon.org/ns#"}], "id": "https://m.example/users/a"}`,
+	} {
+		var actor Actor
+		if err := json.Unmarshal([]byte(document), &actor); err != nil {
+			t.Errorf("couldn't decode %s: %v", document, err)
+		} else if actor.Id != "https://m.example/users/a" {
+			t.Errorf("got id %q", actor.Id)
+		}
+	}
+}